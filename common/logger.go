@@ -0,0 +1,120 @@
+package common
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Logger is the method set of *slog.Logger, so a *slog.Logger can be used directly.
+// args are alternating keys and values, see LogKey constants for common keys.
+type Logger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+// common keys of log args
+const (
+	LogKeyConn       = "conn"
+	LogKeyNodeId     = "node_id"
+	LogKeyActivityId = "activity_id"
+	LogKeyMessageId  = "message_id"
+	LogKeyError      = "err"
+)
+
+// LogLevel has the same values as slog.Level
+type LogLevel int
+
+const (
+	LogLevelDebug LogLevel = -4
+	LogLevelInfo  LogLevel = 0
+	LogLevelWarn  LogLevel = 4
+	LogLevelError LogLevel = 8
+)
+
+func (l LogLevel) String() string {
+	switch {
+	case l < LogLevelInfo:
+		return "DEBUG"
+	case l < LogLevelWarn:
+		return "INFO"
+	case l < LogLevelError:
+		return "WARN"
+	}
+
+	return "ERROR"
+}
+
+type stdLogger struct {
+	logger *log.Logger
+	level  LogLevel
+}
+
+// NewStdLogger writes records at or above level to a standard library logger in key=value form
+func NewStdLogger(logger *log.Logger, level LogLevel) Logger {
+	return &stdLogger{
+		logger: logger,
+		level:  level,
+	}
+}
+
+var defaultLogger = NewStdLogger(log.Default(), LogLevelWarn)
+
+// LoggerOrDefault returns the default logger if l is nil,
+// the default writes warnings and errors to log.Default() only
+func LoggerOrDefault(l Logger) Logger {
+	if l == nil {
+		return defaultLogger
+	}
+
+	return l
+}
+
+func (l *stdLogger) log(level LogLevel, msg string, args []interface{}) {
+	if level < l.level {
+		return
+	}
+
+	var b strings.Builder
+	b.WriteString(level.String())
+	b.WriteString(" ")
+	b.WriteString(msg)
+
+	for i := 0; i < len(args); i += 2 {
+		if i+1 < len(args) {
+			fmt.Fprintf(&b, " %v=%v", args[i], args[i+1])
+		} else {
+			fmt.Fprintf(&b, " !BADKEY=%v", args[i])
+		}
+	}
+
+	l.logger.Output(3, b.String())
+}
+
+func (l *stdLogger) Debug(msg string, args ...interface{}) {
+	l.log(LogLevelDebug, msg, args)
+}
+
+func (l *stdLogger) Info(msg string, args ...interface{}) {
+	l.log(LogLevelInfo, msg, args)
+}
+
+func (l *stdLogger) Warn(msg string, args ...interface{}) {
+	l.log(LogLevelWarn, msg, args)
+}
+
+func (l *stdLogger) Error(msg string, args ...interface{}) {
+	l.log(LogLevelError, msg, args)
+}
+
+type nopLogger struct{}
+
+// NopLogger discards everything
+var NopLogger Logger = nopLogger{}
+
+func (nopLogger) Debug(string, ...interface{}) {}
+func (nopLogger) Info(string, ...interface{})  {}
+func (nopLogger) Warn(string, ...interface{})  {}
+func (nopLogger) Error(string, ...interface{}) {}
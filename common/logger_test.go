@@ -0,0 +1,30 @@
+package common
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"testing"
+)
+
+func TestStdLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewStdLogger(log.New(&buf, "", 0), LogLevelInfo)
+
+	l.Debug("hidden")
+	l.Info("connected", LogKeyConn, "127.0.0.1:1", LogKeyError, fmt.Errorf("eof"))
+	l.Warn("odd", "key")
+
+	expected := "INFO connected conn=127.0.0.1:1 err=eof\nWARN odd !BADKEY=key\n"
+	if buf.String() != expected {
+		t.Errorf("expected %q got %q", expected, buf.String())
+	}
+
+	if LoggerOrDefault(nil) != defaultLogger {
+		t.Errorf("expected default logger")
+	}
+
+	if LoggerOrDefault(NopLogger) != NopLogger {
+		t.Errorf("expected given logger")
+	}
+}
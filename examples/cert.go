@@ -1,3 +1,6 @@
+//go:build windows || darwin
+// +build windows darwin
+
 package examples
 
 import (
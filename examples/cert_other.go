@@ -0,0 +1,14 @@
+//go:build !windows && !darwin
+// +build !windows,!darwin
+
+package examples
+
+import (
+	"crypto/tls"
+
+	"github.com/tg123/phabrik/transport"
+)
+
+func FindCert(thumbprint string) (*tls.Certificate, error) {
+	return transport.FindCertificateByThumbprint(transport.LinuxCertificateStore, thumbprint)
+}
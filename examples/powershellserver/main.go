@@ -1,12 +1,6 @@
-//go:build windows
-// +build windows
-
 package main
 
 import (
-	"crypto/sha1"
-	"crypto/tls"
-	"crypto/x509"
 	"fmt"
 	"log"
 	"os"
@@ -20,24 +14,21 @@ import (
 )
 
 func main() {
-	// usage powershellserver <listen address> <server thumbprint>
+	// usage powershellserver <listen address> <server thumbprint> <client thumbprint>
 
 	cert, err := examples.FindCert(os.Args[2])
 	if err != nil {
 		panic(err)
 	}
 
-	tlsconf := &tls.Config{
-		Certificates: []tls.Certificate{*cert},
-		ClientAuth:   tls.RequestClientCert,
-		VerifyPeerCertificate: func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
-			for _, rawCert := range rawCerts {
-				thumb := fmt.Sprintf("%x", sha1.Sum(rawCert))
-				fmt.Println("Client thumbprint", thumb)
-			}
+	settings := transport.SecuritySettings{
+		Certificate:           cert,
+		RemoteCertThumbprints: []string{os.Args[3]},
+	}
 
-			return nil
-		},
+	tlsconf, err := settings.ServerTLSConfig()
+	if err != nil {
+		panic(err)
 	}
 
 	s, err := transport.ListenTCP(os.Args[1], transport.ServerConfig{
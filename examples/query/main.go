@@ -1,14 +1,7 @@
-//go:build windows
-// +build windows
-
 package main
 
 import (
 	"context"
-	"crypto/sha1"
-	"crypto/tls"
-	"crypto/x509"
-	"fmt"
 	"log"
 	"os"
 	"time"
@@ -20,24 +13,21 @@ import (
 )
 
 func main() {
-	// usage query <service fabric endpoint> <client thumbprint>
+	// usage query <service fabric endpoint> <client thumbprint> <server thumbprint>
 
 	cert, err := examples.FindCert(os.Args[2])
 	if err != nil {
 		panic(err)
 	}
 
-	tlsconf := &tls.Config{
-		Certificates:       []tls.Certificate{*cert},
-		InsecureSkipVerify: true,
-		VerifyPeerCertificate: func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
-			for _, rawCert := range rawCerts {
-				thumb := fmt.Sprintf("%x", sha1.Sum(rawCert))
-				fmt.Println("Remote thumbprint", thumb)
+	settings := transport.SecuritySettings{
+		Certificate:           cert,
+		RemoteCertThumbprints: []string{os.Args[3]},
+	}
 
-			}
-			return nil
-		},
+	tlsconf, err := settings.ClientTLSConfig()
+	if err != nil {
+		panic(err)
 	}
 
 	c, err := transport.DialTCP(os.Args[1], transport.ClientConfig{
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"sync"
 
+	"github.com/tg123/phabrik/common"
 	"github.com/tg123/phabrik/lease"
 	"github.com/tg123/phabrik/transport"
 )
@@ -27,6 +28,8 @@ type SiteNode struct {
 
 	parteners       map[NodeID]*PartnerNodeInfo
 	partenersRWLock sync.RWMutex
+
+	logger common.Logger
 }
 
 type SeedNodeInfo struct {
@@ -41,6 +44,9 @@ type SiteNodeConfig struct {
 	LeaseAgent      *lease.Agent
 	Instance        NodeInstance
 	SeedNodes       []SeedNodeInfo
+
+	// Logger only warnings and errors are written to log.Default() if nil
+	Logger common.Logger
 }
 
 func NewSiteNode(config SiteNodeConfig) (*SiteNode, error) {
@@ -63,11 +69,14 @@ func NewSiteNode(config SiteNodeConfig) (*SiteNode, error) {
 		phaseChanged:       make(chan int),
 		parteners:          make(map[NodeID]*PartnerNodeInfo),
 		messageIdGenerator: msgfac,
+		logger:             common.LoggerOrDefault(config.Logger),
 	}
 
 	copy(s.seedNodes, config.SeedNodes)
 
 	s.transportServer.SetMessageCallback(s.onMessage)
+	// requests are sent one way and correlated by requestTable
+	s.transportServer.SetUncorrelatedReplyCallback(s.onMessage)
 	// s.routing.onPartnerChanged = s.onPartnerChanged
 
 	s.clientDialer = config.ClientDialer
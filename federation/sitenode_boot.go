@@ -2,10 +2,10 @@ package federation
 
 import (
 	"context"
-	"log"
 	"sync"
 	"time"
 
+	"github.com/tg123/phabrik/common"
 	"github.com/tg123/phabrik/transport"
 )
 
@@ -17,7 +17,7 @@ func (s *SiteNode) Bootstrap(ctx context.Context) error {
 	for {
 		for _, seed := range s.seedNodes {
 			if err := s.votePing(seed.Id); err != nil {
-				log.Printf("send vote ping to %v failed %v", seed.Address, err)
+				s.logger.Debug("send vote ping failed", common.LogKeyNodeId, seed.Id, "address", seed.Address, common.LogKeyError, err)
 			}
 		}
 
@@ -57,7 +57,7 @@ func (s *SiteNode) Discover(ctx context.Context) ([]PartnerNodeInfo, error) {
 			go func(p *PartnerNodeInfo) {
 				defer wg.Done()
 				if err := s.votePing(p.Instance.Id); err != nil {
-					log.Printf("send vote ping to %v failed %v", p.Address, err)
+					s.logger.Debug("send vote ping failed", common.LogKeyNodeId, p.Instance.Id, "address", p.Address, common.LogKeyError, err)
 				}
 			}(&partner)
 		}
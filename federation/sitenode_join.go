@@ -2,7 +2,6 @@ package federation
 
 import (
 	"context"
-	"fmt"
 
 	"github.com/tg123/phabrik/common"
 	"github.com/tg123/phabrik/serialization"
@@ -30,15 +29,19 @@ func (s *SiteNode) neighborhoodQuery(ctx context.Context) error {
 
 	var global GlobalLease
 
-	serialization.Unmarshal(reply.Body, &global)
+	if err := serialization.Unmarshal(reply.Body, &global); err != nil {
+		return err
+	}
 
-	fmt.Println("reply", global)
+	s.logger.Debug("neighborhood query reply", common.LogKeyNodeId, s.instance.Id, common.LogKeyMessageId, reply.Headers.Id, "global_lease", global)
 
 	return nil
 }
 
 func (s *SiteNode) Join(ctx context.Context) error {
-	s.neighborhoodQuery(ctx)
+	if err := s.neighborhoodQuery(ctx); err != nil {
+		s.logger.Warn("neighborhood query failed", common.LogKeyNodeId, s.instance.Id, common.LogKeyError, err)
+	}
 
 	return nil
 }
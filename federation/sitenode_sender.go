@@ -35,6 +35,7 @@ func (c *cachedConn) Conn() *transport.Client {
 		}
 
 		conn.SetMessageCallback(c.parent.onMessage)
+		conn.SetUncorrelatedReplyCallback(c.parent.onMessage)
 
 		go func() {
 			defer c.Close()
@@ -145,6 +146,7 @@ func (s *SiteNode) Route(ctx context.Context, id NodeID, msg *transport.Message)
 
 	s.fillMessageId(msg)
 	s.appendPartnerInfo(msg)
+	transport.ApplyActivity(ctx, &msg.Headers)
 
 	msg.Headers.SetCustomHeader(transport.MessageHeaderIdTypePToP, &PToPHeader{
 		From:          s.instance,
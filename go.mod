@@ -5,6 +5,7 @@ go 1.18
 require (
 	github.com/sigurn/crc8 v0.0.0-20220107193325-2243fe600f9f
 	github.com/stretchr/testify v1.7.0
+	golang.org/x/crypto v0.8.0
 )
 
 require (
@@ -3,11 +3,14 @@ package lease
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
-	"strconv"
+	"sort"
 	"sync"
 	"time"
+
+	"github.com/tg123/phabrik/common"
 )
 
 func uniqId() int64 {
@@ -23,6 +26,22 @@ const (
 	LeaseAgentStateFailed
 )
 
+func (s LeaseAgentState) String() string {
+	switch s {
+	case LeaseAgentStateOpen:
+		return "Open"
+	case LeaseAgentStateSuspended:
+		return "Suspended"
+	case LeaseAgentStateFailed:
+		return "Failed"
+	}
+
+	return fmt.Sprintf("LeaseAgentState(%d)", int32(s))
+}
+
+// SessionStateCallback is called when a session moves to a new state
+type SessionStateCallback func(s Session, state LeaseAgentState)
+
 type AgentConfig struct {
 	TLS                      *tls.Config
 	AppId                    string
@@ -30,6 +49,36 @@ type AgentConfig struct {
 	ApplicationLeaseDuration time.Duration
 	LeaseSuspendTimeout      time.Duration
 	ArbitrationTimeout       time.Duration
+
+	// ListenEndpoint is the host:port sent to peers, the listener address if empty.
+	// Hostnames are sent with an unspecified resolve type and resolved by the peer.
+	ListenEndpoint string
+
+	// AddressFamilyInet6 is the resolve type sent with ipv6 endpoints, the windows AF_INET6 (23) if 0.
+	// Set it to 10 when the peers run on linux.
+	AddressFamilyInet6 uint16
+
+	// StateCallback is called from the session goroutine, it must not block
+	StateCallback SessionStateCallback
+
+	// Arbitrator is asked which side survives once a lease expires, sessions just fail after LeaseSuspendTimeout if nil
+	Arbitrator Arbitrator
+
+	// FailedCallback is called once when the agent loses arbitration and must go down
+	FailedCallback func(a *Agent, err error)
+
+	// TerminatedCallback is called when a remote agent terminates its leases with us two-way
+	TerminatedCallback func(a *Agent, endpoint string)
+
+	// RelayEndpoints are agents asked to forward lease requests when the remote cannot be reached directly
+	RelayEndpoints []string
+
+	// Relay lets the agent forward lease requests of other agents, only to RelayTargets and remotes it has a session with
+	Relay        bool
+	RelayTargets []string
+
+	// Logger only warnings and errors are written to log.Default() if nil
+	Logger common.Logger
 }
 
 func (c *AgentConfig) SetDefault() {
@@ -47,12 +96,39 @@ type Agent struct {
 	config        AgentConfig
 	marshaller    marshalContext
 	sessions      sync.Map
+	remotes       sync.Map
+	relayed       sync.Map
+	peers         sync.Map
+	incoming      sync.Map
 	listener      net.Listener
-	dial          Dialer
+	logger        common.Logger
+	// endpoint is the advertised listen endpoint, peers know us by it
+	endpoint string
+
+	dialLock sync.Mutex
+	dial     Dialer
+
+	// sessionsLock makes replacing and removing a session atomic with checking the one stored
+	sessionsLock sync.Mutex
+
+	stateLock sync.Mutex
+	state     LeaseAgentState
+	failure   error
 }
 
 var errAgentClosed = fmt.Errorf("agent closed")
 
+var ErrLeaseRejected = errors.New("lease rejected")
+
+// ErrLeaseFailed is returned once a session has failed, a failed lease cannot be renewed
+var ErrLeaseFailed = errors.New("lease failed")
+
+const (
+	defaultLeaseDuration = 30 * time.Second
+	minReconnectBackoff  = 100 * time.Millisecond
+	maxReconnectBackoff  = 5 * time.Second
+)
+
 func closedDialer(addr string) (net.Conn, error) {
 	return nil, errAgentClosed
 }
@@ -75,23 +151,27 @@ func NewAgent(config AgentConfig, listener net.Listener, dial Dialer) (*Agent, e
 		dial:          dial,
 		listener:      listener,
 		LocalInstance: uniqId(),
+		logger:        common.LoggerOrDefault(config.Logger),
 	}
 	a.config = config
 
-	host, port, err := net.SplitHostPort(listener.Addr().String())
-	if err != nil {
-		return nil, err
+	endpoint := config.ListenEndpoint
+	if endpoint == "" {
+		endpoint = listener.Addr().String()
 	}
 
-	p, err := strconv.Atoi(port)
+	ep, err := parseListenEndpoint(endpoint)
 	if err != nil {
 		return nil, err
 	}
 
+	a.endpoint = ep.String()
 	a.marshaller = marshalContext{
-		AppId:   config.AppId,
-		Address: host,
-		Port:    uint16(p),
+		AppId:              config.AppId,
+		Address:            ep.Address,
+		Port:               ep.Port,
+		LeaseAgentInstance: a.LocalInstance,
+		AddressFamilyInet6: config.AddressFamilyInet6,
 	}
 
 	return &a, nil
@@ -101,26 +181,143 @@ func (a *Agent) Addr() net.Addr {
 	return a.listener.Addr()
 }
 
+// State is Failed once the agent lost arbitration, Err returns the reason
+func (a *Agent) State() LeaseAgentState {
+	a.stateLock.Lock()
+	defer a.stateLock.Unlock()
+
+	return a.state
+}
+
+func (a *Agent) Err() error {
+	a.stateLock.Lock()
+	defer a.stateLock.Unlock()
+
+	return a.failure
+}
+
+func (a *Agent) fail(err error) {
+	a.stateLock.Lock()
+	if a.state == LeaseAgentStateFailed {
+		a.stateLock.Unlock()
+		return
+	}
+	a.state = LeaseAgentStateFailed
+	a.failure = err
+	a.stateLock.Unlock()
+
+	a.logger.Error("lease agent failed", common.LogKeyError, err)
+
+	if cb := a.config.FailedCallback; cb != nil {
+		cb(a, err)
+	}
+}
+
+// Establish dials addr and runs the lease handshake with the application of the peer.
+// It blocks the caller up to the lease duration waiting for the response, use EstablishContext to bound it.
 func (a *Agent) Establish(addr string) (Session, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), a.leaseDuration())
+	defer cancel()
+
+	return a.EstablishContext(ctx, addr)
+}
+
+// EstablishContext dials addr and runs the lease handshake, the remote AppId is learned from the response.
+// It blocks until the response arrives or ctx is done, the lease is renewed until the session is closed.
+// An existing session to addr is returned as is.
+func (a *Agent) EstablishContext(ctx context.Context, addr string) (Session, error) {
+	return a.EstablishApp(ctx, addr, "")
+}
+
+// EstablishApp runs the lease handshake with remoteAppId at addr, the peer rejects the lease if it is not its AppId.
+// An empty remoteAppId accepts any application, as EstablishContext does.
+func (a *Agent) EstablishApp(ctx context.Context, addr string, remoteAppId string) (Session, error) {
+	// a failed session cannot be renewed, establish a new one in its place
+	if s, ok := a.Find(addr); ok && s.State() != LeaseAgentStateFailed {
+		return s, nil
+	}
+
 	s := leaseSession{
 		addr:          addr,
 		parent:        a,
 		pingCh:        make(chan int),
+		leaseCh:       make(chan *Message, 1),
+		expiryCh:      make(chan struct{}, 1),
+		done:          make(chan struct{}),
 		localInstance: uniqId(),
+		remoteAppId:   remoteAppId,
 	}
 
-	err := s.reconnect()
-	if err != nil {
+	// the peer may have pinged us first, reuse the connection our replies went through
+	if p, ok := a.peers.LoadAndDelete(addr); ok {
+		if c := p.(*peerConn).take(); c != nil {
+			s.conn = c
+			s.connected = true
+		}
+	}
+
+	if err := s.reconnect(); err != nil {
+		if len(a.config.RelayEndpoints) == 0 {
+			return nil, err
+		}
+
+		a.logger.Debug("lease dial failed, establishing through relays", "endpoint", addr, common.LogKeyError, err)
+	}
+
+	// store before the handshake so the response can be routed back
+	if existing, ok := a.storeSession(&s); !ok {
+		s.closeConn()
+		return existing, nil
+	}
+
+	if err := s.establish(ctx); err != nil {
+		s.Close()
 		return nil, err
 	}
 
-	a.sessions.Store(addr, &s)
+	go s.renewLoop()
+	go s.stateLoop()
 
 	return &s, nil
 }
 
+// storeSession stores s unless a live session to the same endpoint is stored already, which is returned instead.
+// A failed session is replaced and closed.
+func (a *Agent) storeSession(s *leaseSession) (*leaseSession, bool) {
+	a.sessionsLock.Lock()
+	existing, loaded := a.sessions.Load(s.addr)
+	if loaded && existing.(*leaseSession).State() != LeaseAgentStateFailed {
+		a.sessionsLock.Unlock()
+		return existing.(*leaseSession), false
+	}
+
+	a.sessions.Store(s.addr, s)
+	a.sessionsLock.Unlock()
+
+	if loaded {
+		existing.(*leaseSession).Close()
+	}
+
+	return s, true
+}
+
+// removeSession removes s unless it was replaced by a newer session
+func (a *Agent) removeSession(s *leaseSession) {
+	a.sessionsLock.Lock()
+	defer a.sessionsLock.Unlock()
+
+	if existing, ok := a.sessions.Load(s.addr); ok && existing == s {
+		a.sessions.Delete(s.addr)
+	}
+}
+
 func (a *Agent) Find(addr string) (Session, bool) {
-	return nil, false
+	s, ok := a.sessions.Load(addr)
+	if !ok {
+		return nil, false
+	}
+
+	return s.(Session), true
 }
 
 func (a *Agent) Wait() error {
@@ -130,15 +327,27 @@ func (a *Agent) Wait() error {
 		c, err := a.listener.Accept()
 
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+
+			a.logger.Warn("lease accepting error", common.LogKeyError, err)
 			continue
 		}
 
-		go a.handleIncoming(c)
+		go func() {
+			if err := a.handleIncoming(c); err != nil {
+				a.logger.Debug("lease connection closed", common.LogKeyConn, c.RemoteAddr(), common.LogKeyError, err)
+			}
+		}()
 	}
 }
 
 func (a *Agent) Close() error {
+	a.dialLock.Lock()
 	a.dial = closedDialer
+	a.dialLock.Unlock()
+
 	a.listener.Close()
 	a.sessions.Range(func(key, value interface{}) bool {
 		if s, ok := value.(Session); ok {
@@ -147,11 +356,158 @@ func (a *Agent) Close() error {
 
 		return true
 	})
+	a.incoming.Range(func(key, value interface{}) bool {
+		key.(net.Conn).Close()
+		return true
+	})
+	a.peers.Range(func(key, value interface{}) bool {
+		value.(*peerConn).close()
+		a.peers.Delete(key)
+		return true
+	})
 
 	return nil
 }
 
+func (a *Agent) dialTLS(addr string) (net.Conn, error) {
+	a.dialLock.Lock()
+	dial := a.dial
+	a.dialLock.Unlock()
+
+	c, err := dial(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if a.config.TLS != nil {
+		c = tls.Client(c, a.config.TLS)
+	}
+
+	return c, nil
+}
+
+// send writes a message to the listen endpoint of a peer,
+// lease connections are one way, replies always go through a connection dialed to the peer
+func (a *Agent) send(endpoint string, msg *Message) error {
+	if s, ok := a.sessions.Load(endpoint); ok {
+		if ls, ok := s.(*leaseSession); ok {
+			return ls.send(msg)
+		}
+	}
+
+	data, err := a.marshaller.marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	p, _ := a.peers.LoadOrStore(endpoint, &peerConn{addr: endpoint, dial: a.dialTLS})
+	return p.(*peerConn).write(data)
+}
+
+func (a *Agent) onPingRequest(m *Message) error {
+	reply := Message{}
+	reply.Type = LeaseMessageTypePingResponse
+	reply.Expiration = a.config.LeaseDuration
+	reply.LeaseInstance = m.LeaseInstance
+	reply.RemoteLeaseAgentInstance = a.LocalInstance
+
+	return a.send(m.MessageListenEndpoint, &reply)
+}
+
+func (a *Agent) leaseDuration() time.Duration {
+	if a.config.LeaseDuration > 0 {
+		return a.config.LeaseDuration
+	}
+
+	return defaultLeaseDuration
+}
+
+// negotiateDuration picks the longer of both sides so neither expires the lease early
+func (a *Agent) negotiateDuration(requested time.Duration) time.Duration {
+	d := a.leaseDuration()
+	if requested > d {
+		return requested
+	}
+
+	return d
+}
+
+func (a *Agent) onLeaseRequest(m *Message) error {
+	return a.send(m.MessageListenEndpoint, a.leaseResponse(m))
+}
+
+// leaseResponse answers a lease request, terminations in the request take effect here
+func (a *Agent) leaseResponse(m *Message) *Message {
+	reply := Message{}
+	reply.Type = LeaseMessageTypeLeaseResponse
+	reply.LeaseInstance = m.LeaseInstance
+	reply.RemoteLeaseAgentInstance = a.LocalInstance
+	reply.Duration = a.negotiateDuration(m.Duration)
+	reply.LeaseSuspendDuration = a.config.LeaseSuspendTimeout
+	reply.ArbitrationDuration = a.config.ArbitrationTimeout
+
+	for _, r := range m.SubjectEstablishPendingList {
+		// relationship from our side, an empty remote lets the requester learn our AppId
+		rel := RelationshipIdentifier{Local: r.Remote, Remote: r.Local}
+		if rel.Local == "" {
+			rel.Local = a.config.AppId
+		}
+
+		if rel.Local != a.config.AppId {
+			reply.SubjectPendingRejectedList = append(reply.SubjectPendingRejectedList, rel)
+			continue
+		}
+
+		reply.SubjectPendingAcceptedList = append(reply.SubjectPendingAcceptedList, rel)
+	}
+
+	if len(reply.SubjectPendingAcceptedList) > 0 {
+		a.remotes.Store(m.MessageListenEndpoint, RemoteLease{
+			Endpoint:       m.MessageListenEndpoint,
+			RemoteInstance: m.LeaseAgentInstance,
+			LeaseInstance:  m.LeaseInstance,
+			Relationships:  reply.SubjectPendingAcceptedList,
+			LeaseDuration:  reply.Duration,
+			LeaseExpiry:    time.Now().Add(reply.Duration),
+		})
+	}
+
+	a.acceptTermination(m, &reply)
+
+	return &reply
+}
+
+// RemoteLease is the lease a remote agent holds with us, kept on the responding side
+type RemoteLease struct {
+	Endpoint string
+	// RemoteInstance is the agent instance of the requester, zero if it sends no message extension
+	RemoteInstance int64
+	// LeaseInstance identifies the lease relationship of the requester
+	LeaseInstance int64
+	// Relationships are the accepted relationships from our side
+	Relationships []RelationshipIdentifier
+	LeaseDuration time.Duration
+	LeaseExpiry   time.Time
+}
+
+// RemoteLeases lists leases granted to remote agents ordered by endpoint, terminated leases are removed
+func (a *Agent) RemoteLeases() []RemoteLease {
+	var l []RemoteLease
+	a.remotes.Range(func(key, value interface{}) bool {
+		l = append(l, value.(RemoteLease))
+		return true
+	})
+
+	sort.Slice(l, func(i, j int) bool {
+		return l[i].Endpoint < l[j].Endpoint
+	})
+
+	return l
+}
+
 func (a *Agent) handleIncoming(conn net.Conn) error {
+	a.incoming.Store(conn, struct{}{})
+	defer a.incoming.Delete(conn)
 	defer conn.Close()
 
 	if a.config.TLS != nil {
@@ -173,8 +529,31 @@ func (a *Agent) handleIncoming(conn net.Conn) error {
 			return err
 		}
 
+		switch m.Type {
+		case LeaseMessageTypePingRequest:
+			if err := a.onPingRequest(m); err != nil {
+				a.logger.Debug("lease ping response failed", "endpoint", m.MessageListenEndpoint, common.LogKeyError, err)
+			}
+			continue
+		case LeaseMessageTypeLeaseRequest:
+			if err := a.onLeaseRequest(m); err != nil {
+				a.logger.Debug("lease response failed", "endpoint", m.MessageListenEndpoint, common.LogKeyError, err)
+			}
+			continue
+		case LeaseMessageTypeForwardRequest, LeaseMessageTypeRelayRequest, LeaseMessageTypeRelayResponse:
+			if err := a.onRelayMessage(m); err != nil {
+				a.logger.Debug("lease relay failed", "endpoint", m.MessageListenEndpoint, "lease_endpoint", m.LeaseListenEndpoint, common.LogKeyError, err)
+			}
+			continue
+		case LeaseMessageTypeForwardResponse:
+			// response of the remote relayed back to us, handled as if it came directly
+			m.Type = LeaseMessageTypeLeaseResponse
+			m.MessageListenEndpoint = m.LeaseListenEndpoint
+		}
+
 		s, ok := a.sessions.Load(m.MessageListenEndpoint)
 		if !ok {
+			a.logger.Debug("lease message from unknown endpoint dropped", common.LogKeyConn, conn.RemoteAddr(), "endpoint", m.MessageListenEndpoint)
 			continue
 		}
 
@@ -186,17 +565,49 @@ func (a *Agent) handleIncoming(conn net.Conn) error {
 }
 
 type SessionMetadata struct {
+	// LocalInstance and RemoteInstance are the lease agent instances of both sides
 	LocalInstance  int64
 	RemoteInstance int64
+	// LeaseInstance identifies this lease relationship
+	LeaseInstance  int64
+	RemoteAppId    string
 	RemoteEndpoint string
+	State          LeaseAgentState
+	LeaseDuration  time.Duration
+	LeaseExpiry    time.Time
+	LastPongTime   time.Time
+	LastPingRTT    time.Duration
+	// MissedPings counts pings without response since the last pong
+	MissedPings  uint64
+	Arbitrations []ArbitrationRecord
+}
+
+// Sessions lists the metadata of all sessions ordered by remote endpoint
+func (a *Agent) Sessions() []SessionMetadata {
+	var l []SessionMetadata
+	a.sessions.Range(func(key, value interface{}) bool {
+		if s, ok := value.(Session); ok {
+			l = append(l, s.Meta())
+		}
+		return true
+	})
+
+	sort.Slice(l, func(i, j int) bool {
+		return l[i].RemoteEndpoint < l[j].RemoteEndpoint
+	})
+
+	return l
 }
 
 type Session interface {
 	Meta() SessionMetadata
-	// State() LeaseAgentState
+	State() LeaseAgentState
 	Ping(ctx context.Context) error
+	// Terminate ends the lease on both sides, see leaseSession.Terminate
+	Terminate(ctx context.Context) error
 
 	LastPongTime() time.Time
+	LeaseExpiry() time.Time
 
 	Close() error
 }
@@ -204,8 +615,9 @@ type Session interface {
 func PingLoop(ctx context.Context, sess Session, interval time.Duration) error {
 
 	for {
-		ctx0, _ := context.WithTimeout(ctx, interval)
-		sess.Ping(ctx0) // TODO ignore error atm, introduce arbitrator later
+		ctx0, cancel := context.WithTimeout(ctx, interval)
+		sess.Ping(ctx0) // errors ignored, lease expiry and arbitration decide failures
+		cancel()
 
 		select {
 		case <-ctx.Done():
@@ -221,37 +633,148 @@ type leaseSession struct {
 	parent         *Agent
 	localInstance  int64
 	remoteInstance int64
+	// remoteAppId is empty until learned from the first response if not given to EstablishApp
+	remoteAppId string
 
 	closed    bool
 	conn      net.Conn
 	connected bool
+	backoff   time.Duration
+	nextDial  time.Time
+	dialErr   error
 	objLock   sync.Mutex
-
-	pingCh   chan int
-	pingLock sync.RWMutex
-	lastpong time.Time
+	writeLock sync.Mutex
+
+	pingCh      chan int
+	pingLock    sync.RWMutex
+	lastpong    time.Time
+	lastRTT     time.Duration
+	missedPings uint64
+
+	arbitrations []ArbitrationRecord
+
+	leaseCh   chan *Message
+	leaseLock sync.Mutex
+	duration  time.Duration
+	// arbitrationDuration is the arbitration timeout of the remote from its last response
+	arbitrationDuration time.Duration
+	expiry              time.Time
+	expiryCh            chan struct{}
+	state               LeaseAgentState
+	done                chan struct{}
 }
 
 func (s *leaseSession) Meta() SessionMetadata {
-	return SessionMetadata{}
-}
+	s.objLock.Lock()
+	defer s.objLock.Unlock()
 
-// func (s *leaseSession) State() LeaseAgentState {
-// 	return LeaseAgentStateFailed
-// }
+	return SessionMetadata{
+		LocalInstance:  s.parent.LocalInstance,
+		RemoteInstance: s.remoteInstance,
+		LeaseInstance:  s.localInstance,
+		RemoteAppId:    s.remoteAppId,
+		RemoteEndpoint: s.addr,
+		State:          s.state,
+		LeaseDuration:  s.duration,
+		LeaseExpiry:    s.expiry,
+		LastPongTime:   s.lastpong,
+		LastPingRTT:    s.lastRTT,
+		MissedPings:    s.missedPings,
+		Arbitrations:   append([]ArbitrationRecord(nil), s.arbitrations...),
+	}
+}
 
-func (s *leaseSession) Close() error {
-	s.parent.sessions.Delete(s.addr)
+func (s *leaseSession) State() LeaseAgentState {
 	s.objLock.Lock()
 	defer s.objLock.Unlock()
 
+	return s.state
+}
+
+// stateAt must be called with objLock held, it returns the state and when it ends
+func (s *leaseSession) stateAt(now time.Time) (LeaseAgentState, time.Time) {
+	if s.state == LeaseAgentStateFailed {
+		return LeaseAgentStateFailed, time.Time{}
+	}
+
+	if now.Before(s.expiry) {
+		return LeaseAgentStateOpen, s.expiry
+	}
+
+	failAt := s.expiry.Add(s.parent.config.LeaseSuspendTimeout)
+	if now.Before(failAt) {
+		return LeaseAgentStateSuspended, failAt
+	}
+
+	return LeaseAgentStateFailed, time.Time{}
+}
+
+func (s *leaseSession) setState(state LeaseAgentState) {
+	s.objLock.Lock()
+	old := s.state
+	if old == state || old == LeaseAgentStateFailed {
+		s.objLock.Unlock()
+		return
+	}
+	s.state = state
+	s.objLock.Unlock()
+
+	s.parent.logger.Debug("lease session state changed", "endpoint", s.addr, "from", old, "to", state)
+
+	if cb := s.parent.config.StateCallback; cb != nil {
+		cb(s, state)
+	}
+
+	if state == LeaseAgentStateSuspended && s.parent.config.Arbitrator != nil {
+		go s.arbitrate()
+	}
+}
+
+// stateLoop moves the session Open -> Suspended once the lease expires
+// and Suspended -> Failed once LeaseSuspendTimeout passes without renewal
+func (s *leaseSession) stateLoop() {
+	for {
+		s.objLock.Lock()
+		state, until := s.stateAt(time.Now())
+		s.objLock.Unlock()
+
+		s.setState(state)
+
+		if state == LeaseAgentStateFailed {
+			return
+		}
+
+		timer := time.NewTimer(time.Until(until))
+
+		select {
+		case <-s.done:
+			timer.Stop()
+			return
+		case <-s.expiryCh:
+		case <-timer.C:
+		}
+
+		timer.Stop()
+	}
+}
+
+func (s *leaseSession) Close() error {
+	s.objLock.Lock()
 	if s.closed {
+		s.objLock.Unlock()
 		return nil
 	}
 
 	s.closed = true
-	s.conn.Close()
+	close(s.done)
+	if s.conn != nil {
+		s.conn.Close()
+	}
 	s.boardcastPong() // unlock waiting pings
+	s.objLock.Unlock()
+
+	// outside objLock, storeSession checks the state of the stored session under sessionsLock
+	s.parent.removeSession(s)
 
 	return nil
 }
@@ -268,69 +791,279 @@ func (s *leaseSession) reconnect() error {
 		return fmt.Errorf("session closed")
 	}
 
-	c, err := s.parent.dial(s.addr)
+	now := time.Now()
+	if now.Before(s.nextDial) {
+		return fmt.Errorf("reconnect to %v backing off: %w", s.addr, s.dialErr)
+	}
+
+	c, err := s.parent.dialTLS(s.addr)
 	if err != nil {
+		s.backoff *= 2
+		if s.backoff < minReconnectBackoff {
+			s.backoff = minReconnectBackoff
+		}
+
+		if s.backoff > maxReconnectBackoff {
+			s.backoff = maxReconnectBackoff
+		}
+
+		s.nextDial = now.Add(s.backoff)
+		s.dialErr = err
 		return err
 	}
 
-	if s.parent.config.TLS != nil {
-		c = tls.Client(c, s.parent.config.TLS)
+	if s.conn != nil {
+		s.conn.Close()
 	}
 
 	s.conn = c
 	s.connected = true
+	s.backoff = 0
+	s.nextDial = time.Time{}
+	s.dialErr = nil
 	return nil
 }
 
-func (s *leaseSession) Ping(ctx context.Context) error {
-	msg := s.createPingMessage()
+// disconnect drops conn if it is still the current one, the next send redials
+func (s *leaseSession) disconnect(conn net.Conn) {
+	s.objLock.Lock()
+	defer s.objLock.Unlock()
+
+	if s.conn == conn {
+		s.conn.Close()
+		s.connected = false
+	}
+}
+
+func (s *leaseSession) closeConn() {
+	s.objLock.Lock()
+	defer s.objLock.Unlock()
 
+	if s.conn != nil {
+		s.conn.Close()
+	}
+}
+
+// send writes msg to the remote, a broken connection is redialed once
+func (s *leaseSession) send(msg *Message) error {
 	data, err := s.parent.marshaller.marshal(msg)
 	if err != nil {
 		return err
 	}
 
-	if err := writeDataWithFrame(s.conn, data); err != nil {
-		if neterr, ok := err.(net.Error); ok {
-			if !neterr.Temporary() {
-				s.objLock.Lock()
-				s.connected = false
-				s.objLock.Unlock()
+	for retry := 0; ; retry++ {
+		if err := s.reconnect(); err != nil {
+			return err
+		}
+
+		s.objLock.Lock()
+		conn := s.conn
+		s.objLock.Unlock()
 
-				// if err = s.reconnect(); err != nil {
-				// 	return err
-				// }
+		s.writeLock.Lock()
+		err = writeDataWithFrame(conn, data)
+		s.writeLock.Unlock()
 
-				// return s.Ping(ctx)
-			}
+		if err == nil {
+			return nil
+		}
+
+		s.disconnect(conn)
+
+		if retry > 0 {
+			return err
 		}
-		return err
 	}
+}
+
+func (s *leaseSession) Ping(ctx context.Context) error {
+	msg := s.createPingMessage()
 
+	// take the channel before sending so a fast pong is not missed
 	s.pingLock.RLock()
 	ch := s.pingCh
 	s.pingLock.RUnlock()
 
+	start := time.Now()
+	if err := s.send(msg); err != nil {
+		s.missPing()
+		return err
+	}
+
 	select {
 	case <-ctx.Done():
+		s.missPing()
 		return ctx.Err()
 	case <-ch:
-		return nil
 	}
+
+	s.objLock.Lock()
+	if !s.closed {
+		s.lastRTT = time.Since(start)
+	}
+	s.objLock.Unlock()
+
+	return nil
+}
+
+func (s *leaseSession) missPing() {
+	s.objLock.Lock()
+	defer s.objLock.Unlock()
+
+	s.missedPings++
 }
 
 func (s *leaseSession) LastPongTime() time.Time {
+	s.objLock.Lock()
+	defer s.objLock.Unlock()
+
 	return s.lastpong
 }
 
+func (s *leaseSession) RemoteInstance() int64 {
+	s.objLock.Lock()
+	defer s.objLock.Unlock()
+
+	return s.remoteInstance
+}
+
+func (s *leaseSession) LeaseExpiry() time.Time {
+	s.objLock.Lock()
+	defer s.objLock.Unlock()
+
+	return s.expiry
+}
+
+// request sends a lease request, directly or through a relay, and waits for the response accepted by match
+func (s *leaseSession) request(ctx context.Context, req *Message, match func(*Message) bool) (*Message, error) {
+	s.leaseLock.Lock()
+	defer s.leaseLock.Unlock()
+
+	select {
+	case <-s.leaseCh: // stale response
+	default:
+	}
+
+	if err := s.send(req); err != nil {
+		return s.forward(ctx, req, match)
+	}
+
+	return s.wait(ctx, match)
+}
+
+// wait must be called with leaseLock held
+func (s *leaseSession) wait(ctx context.Context, match func(*Message) bool) (*Message, error) {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-s.done:
+			return nil, fmt.Errorf("session closed")
+		case m := <-s.leaseCh:
+			if match(m) {
+				return m, nil
+			}
+		}
+	}
+}
+
+// establish sends a lease request and waits for the response, renewals send the same request again
+func (s *leaseSession) establish(ctx context.Context) error {
+	start := time.Now()
+	m, err := s.request(ctx, s.createLeaseRequest(), func(m *Message) bool {
+		return len(m.SubjectTerminateAcceptedList) == 0
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(m.SubjectPendingRejectedList) > 0 || len(m.SubjectPendingAcceptedList) == 0 {
+		return ErrLeaseRejected
+	}
+
+	s.objLock.Lock()
+	if s.state == LeaseAgentStateFailed {
+		s.objLock.Unlock()
+		return ErrLeaseFailed
+	}
+
+	s.remoteInstance = m.RemoteLeaseAgentInstance
+	if s.remoteAppId == "" {
+		s.remoteAppId = m.SubjectPendingAcceptedList[0].Local
+	}
+	s.duration = m.Duration
+	s.arbitrationDuration = m.ArbitrationDuration
+	s.expiry = start.Add(m.Duration)
+	s.objLock.Unlock()
+
+	select {
+	case s.expiryCh <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+func (s *leaseSession) renewInterval() time.Duration {
+	s.objLock.Lock()
+	defer s.objLock.Unlock()
+
+	// leave room for two more attempts before expiry
+	return s.duration / 3
+}
+
+func (s *leaseSession) renewLoop() {
+	for {
+		interval := s.renewInterval()
+
+		select {
+		case <-s.done:
+			return
+		case <-time.After(interval):
+		}
+
+		if s.State() == LeaseAgentStateFailed {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		err := s.establish(ctx)
+		cancel()
+
+		if errors.Is(err, ErrLeaseFailed) {
+			return
+		}
+
+		if err != nil {
+			s.parent.logger.Debug("lease renew failed", "endpoint", s.addr, common.LogKeyError, err)
+		}
+	}
+}
+
 func (s *leaseSession) onMessage(m *Message) {
 
 	switch m.Type {
-	case LeaseMessageTypePingRequest:
-		// TODO
+	case LeaseMessageTypeLeaseResponse:
+		if m.LeaseInstance != s.localInstance {
+			return
+		}
+
+		// keep the latest response only
+		select {
+		case <-s.leaseCh:
+		default:
+		}
+
+		select {
+		case s.leaseCh <- m:
+		default:
+		}
 	case LeaseMessageTypePingResponse:
+		s.objLock.Lock()
 		s.lastpong = time.Now()
 		s.remoteInstance = m.RemoteLeaseAgentInstance
+		s.missedPings = 0
+		s.objLock.Unlock()
 		s.boardcastPong()
 	default:
 	}
@@ -344,11 +1077,81 @@ func (s *leaseSession) boardcastPong() {
 	s.pingLock.Unlock()
 }
 
+func (s *leaseSession) createLeaseRequest() *Message {
+	message := Message{}
+	message.Type = LeaseMessageTypeLeaseRequest
+	message.Duration = s.parent.leaseDuration()
+	message.LeaseSuspendDuration = s.parent.config.LeaseSuspendTimeout
+	message.ArbitrationDuration = s.parent.config.ArbitrationTimeout
+	message.LeaseInstance = s.localInstance
+	message.RemoteLeaseAgentInstance = s.RemoteInstance()
+	message.SubjectEstablishPendingList = []RelationshipIdentifier{s.relationship()}
+	return &message
+}
+
+func (s *leaseSession) relationship() RelationshipIdentifier {
+	s.objLock.Lock()
+	defer s.objLock.Unlock()
+
+	return RelationshipIdentifier{Local: s.parent.config.AppId, Remote: s.remoteAppId}
+}
+
 func (s *leaseSession) createPingMessage() *Message {
 	message := Message{}
 	message.Type = LeaseMessageTypePingRequest
 	message.Expiration = s.parent.config.LeaseDuration // TODO confirm config entry
 	message.LeaseInstance = s.localInstance
-	message.RemoteLeaseAgentInstance = s.remoteInstance
+	message.RemoteLeaseAgentInstance = s.RemoteInstance()
 	return &message
 }
+
+// peerConn is an outgoing connection to a peer without session, dialed on first write
+type peerConn struct {
+	addr string
+	dial Dialer
+	lock sync.Mutex
+	conn net.Conn
+}
+
+func (p *peerConn) write(data []byte) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.conn == nil {
+		c, err := p.dial(p.addr)
+		if err != nil {
+			return err
+		}
+
+		p.conn = c
+	}
+
+	if err := writeDataWithFrame(p.conn, data); err != nil {
+		// redial on next write
+		p.conn.Close()
+		p.conn = nil
+		return err
+	}
+
+	return nil
+}
+
+// take hands the connection over to a session
+func (p *peerConn) take() net.Conn {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	c := p.conn
+	p.conn = nil
+	return c
+}
+
+func (p *peerConn) close() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.conn != nil {
+		p.conn.Close()
+		p.conn = nil
+	}
+}
@@ -0,0 +1,523 @@
+package lease
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestAgent(t *testing.T) *Agent {
+	var config AgentConfig
+	config.SetDefault()
+
+	return newTestAgentWithConfig(t, config)
+}
+
+func newTestAgentWithConfig(t *testing.T, config AgentConfig) *Agent {
+	a, err := NewTcpListeningAgent(config, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go a.Wait()
+	t.Cleanup(func() { a.Close() })
+
+	return a
+}
+
+func TestAgentPing(t *testing.T) {
+	a := newTestAgent(t)
+	b := newTestAgent(t)
+
+	s, err := a.Establish(b.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	assert.NoError(t, s.Ping(ctx))
+	assert.False(t, s.LastPongTime().IsZero())
+	assert.Equal(t, b.LocalInstance, s.(*leaseSession).RemoteInstance())
+}
+
+// TestAgentAnswerPing acts as a native agent without session on the go side
+func TestAgentAnswerPing(t *testing.T) {
+	a := newTestAgent(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	p, _ := net.LookupPort("tcp", port)
+	marshaller := marshalContext{Address: host, Port: uint16(p)}
+
+	conn, err := net.Dial("tcp", a.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	data, err := marshaller.marshal(&Message{
+		Type:          LeaseMessageTypePingRequest,
+		LeaseInstance: 42,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writeDataWithFrame(conn, data); err != nil {
+		t.Fatal(err)
+	}
+
+	l.(*net.TCPListener).SetDeadline(time.Now().Add(5 * time.Second))
+	reply, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reply.Close()
+
+	body, err := nextLtFrame(reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := unmarshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, LeaseMessageTypePingResponse, m.Type)
+	assert.Equal(t, int64(42), m.LeaseInstance)
+	assert.Equal(t, a.LocalInstance, m.RemoteLeaseAgentInstance)
+	assert.Equal(t, a.LocalInstance, m.LeaseAgentInstance)
+	assert.Equal(t, a.Addr().String(), m.MessageListenEndpoint)
+}
+
+func TestAgentEstablish(t *testing.T) {
+	var config AgentConfig
+	config.SetDefault()
+	config.AppId = "app"
+	config.LeaseDuration = 300 * time.Millisecond
+
+	a := newTestAgentWithConfig(t, config)
+
+	config.LeaseDuration = 600 * time.Millisecond
+	b := newTestAgentWithConfig(t, config)
+
+	t.Run("negotiate and renew", func(t *testing.T) {
+		s, err := a.Establish(b.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		ls := s.(*leaseSession)
+		assert.Equal(t, b.LocalInstance, ls.RemoteInstance())
+		assert.Equal(t, 600*time.Millisecond, ls.duration)
+		assert.Equal(t, "app", s.Meta().RemoteAppId)
+
+		remotes := b.RemoteLeases()
+		if assert.Len(t, remotes, 1) {
+			assert.Equal(t, a.Addr().String(), remotes[0].Endpoint)
+			assert.Equal(t, a.LocalInstance, remotes[0].RemoteInstance)
+			assert.Equal(t, ls.localInstance, remotes[0].LeaseInstance)
+			assert.Equal(t, []RelationshipIdentifier{{Local: "app", Remote: "app"}}, remotes[0].Relationships)
+			assert.Equal(t, 600*time.Millisecond, remotes[0].LeaseDuration)
+		}
+
+		expiry := s.LeaseExpiry()
+		assert.True(t, expiry.After(time.Now()))
+
+		assert.Eventually(t, func() bool {
+			return s.LeaseExpiry().After(expiry)
+		}, 2*time.Second, 50*time.Millisecond)
+	})
+
+	config.AppId = "other"
+	c := newTestAgentWithConfig(t, config)
+
+	t.Run("rejected", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		_, err := a.EstablishApp(ctx, c.Addr().String(), "app")
+		assert.ErrorIs(t, err, ErrLeaseRejected)
+
+		_, ok := a.sessions.Load(c.Addr().String())
+		assert.False(t, ok)
+		assert.Empty(t, c.RemoteLeases())
+	})
+
+	t.Run("remote app learned", func(t *testing.T) {
+		s, err := a.Establish(c.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		assert.Equal(t, "other", s.Meta().RemoteAppId)
+		assert.Equal(t, RelationshipIdentifier{Local: "app", Remote: "other"}, s.(*leaseSession).relationship())
+	})
+}
+
+func TestAgentSessionState(t *testing.T) {
+	var config AgentConfig
+	config.SetDefault()
+	config.LeaseDuration = 300 * time.Millisecond
+	config.LeaseSuspendTimeout = 200 * time.Millisecond
+
+	states := make(chan LeaseAgentState, 4)
+	config.StateCallback = func(s Session, state LeaseAgentState) {
+		states <- state
+	}
+
+	a := newTestAgentWithConfig(t, config)
+	b := newTestAgentWithConfig(t, config)
+
+	s, err := a.Establish(b.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	assert.Equal(t, LeaseAgentStateOpen, s.State())
+
+	// renewals keep the lease open
+	time.Sleep(2 * config.LeaseDuration)
+	assert.Equal(t, LeaseAgentStateOpen, s.State())
+	assert.Empty(t, states)
+
+	b.Close()
+
+	assert.Equal(t, LeaseAgentStateSuspended, <-states)
+	assert.Equal(t, LeaseAgentStateFailed, <-states)
+	assert.Equal(t, LeaseAgentStateFailed, s.State())
+	assert.Equal(t, "Failed", s.State().String())
+}
+
+func TestAgentFind(t *testing.T) {
+	a := newTestAgent(t)
+	b := newTestAgent(t)
+
+	_, ok := a.Find(b.Addr().String())
+	assert.False(t, ok)
+
+	s, err := a.Establish(b.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found, ok := a.Find(b.Addr().String())
+	assert.True(t, ok)
+	assert.Equal(t, s, found)
+
+	again, err := a.Establish(b.Addr().String())
+	assert.NoError(t, err)
+	assert.Equal(t, s, again)
+
+	s.Close()
+	_, ok = a.Find(b.Addr().String())
+	assert.False(t, ok)
+}
+
+func TestAgentReplaceFailedSession(t *testing.T) {
+	a := newTestAgent(t)
+	b := newTestAgent(t)
+
+	s, err := a.Establish(b.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	old := s.(*leaseSession)
+	old.objLock.Lock()
+	old.state = LeaseAgentStateFailed
+	old.objLock.Unlock()
+
+	renewed, err := a.Establish(b.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer renewed.Close()
+
+	assert.NotEqual(t, s, renewed)
+	assert.Equal(t, LeaseAgentStateOpen, renewed.State())
+
+	// the failed session was closed when replaced, closing it again keeps the new one
+	assert.NoError(t, s.Close())
+
+	found, ok := a.Find(b.Addr().String())
+	assert.True(t, ok)
+	assert.Equal(t, renewed, found)
+}
+
+func TestAgentReuseReplyConnection(t *testing.T) {
+	a := newTestAgent(t)
+	b := newTestAgent(t)
+
+	sa, err := a.Establish(b.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sa.Close()
+
+	// b answered through a connection dialed to a, its session takes it over
+	p, ok := b.peers.Load(a.Addr().String())
+	if !ok {
+		t.Fatal("no reply connection")
+	}
+	conn := p.(*peerConn).conn
+
+	sb, err := b.Establish(a.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sb.Close()
+
+	_, ok = b.peers.Load(a.Addr().String())
+	assert.False(t, ok)
+	assert.Equal(t, conn, sb.(*leaseSession).conn)
+}
+
+func TestSessionReconnect(t *testing.T) {
+	var config AgentConfig
+	config.SetDefault()
+	config.LeaseDuration = 600 * time.Millisecond
+	config.LeaseSuspendTimeout = time.Second
+
+	a := newTestAgentWithConfig(t, config)
+	b := newTestAgentWithConfig(t, config)
+	addr := b.Addr().String()
+
+	s, err := a.Establish(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	assert.Equal(t, b.LocalInstance, s.(*leaseSession).RemoteInstance())
+
+	// restart the peer on the same address
+	b.Close()
+
+	var restarted *Agent
+	assert.Eventually(t, func() bool {
+		restarted, err = NewTcpListeningAgent(config, addr)
+		return err == nil
+	}, 2*time.Second, 20*time.Millisecond)
+	if restarted == nil {
+		t.Fatal(err)
+	}
+	go restarted.Wait()
+	defer restarted.Close()
+
+	assert.Eventually(t, func() bool {
+		return s.(*leaseSession).RemoteInstance() == restarted.LocalInstance
+	}, 3*time.Second, 50*time.Millisecond)
+
+	assert.Equal(t, LeaseAgentStateOpen, s.State())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.NoError(t, s.Ping(ctx))
+}
+
+func TestAgentCloseWhileDialing(t *testing.T) {
+	a := newTestAgent(t)
+	b := newTestAgent(t)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			c, err := a.dialTLS(b.Addr().String())
+			if err != nil {
+				assert.ErrorIs(t, err, errAgentClosed)
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	a.Close()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("dial after close")
+	}
+}
+
+func TestSessionReconnectBackoff(t *testing.T) {
+	d := &blockingDialer{blocked: make(map[string]bool)}
+	d.block("127.0.0.1:1")
+
+	var dials int32
+	a := newTestAgent(t)
+	a.dial = func(addr string) (net.Conn, error) {
+		atomic.AddInt32(&dials, 1)
+		return d.dial(addr)
+	}
+
+	s := &leaseSession{addr: "127.0.0.1:1", parent: a}
+
+	for i := 0; i < 10; i++ {
+		assert.Error(t, s.reconnect())
+	}
+
+	// first dial fails, the rest wait for the backoff
+	assert.Equal(t, int32(1), atomic.LoadInt32(&dials))
+	assert.Equal(t, minReconnectBackoff, s.backoff)
+}
+
+func TestAgentIPv6(t *testing.T) {
+	var config AgentConfig
+	config.SetDefault()
+
+	a, err := NewTcpListeningAgent(config, "[::1]:0")
+	if err != nil {
+		t.Skip("ipv6 loopback not available", err)
+	}
+	go a.Wait()
+	defer a.Close()
+
+	b, err := NewTcpListeningAgent(config, "[::1]:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go b.Wait()
+	defer b.Close()
+
+	s, err := a.Establish(b.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	assert.NoError(t, s.Ping(ctx))
+	assert.Equal(t, b.LocalInstance, s.(*leaseSession).RemoteInstance())
+}
+
+func TestAgentHostnameEndpoint(t *testing.T) {
+	var config AgentConfig
+	config.SetDefault()
+
+	b := newTestAgent(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	config.ListenEndpoint = net.JoinHostPort("localhost", port)
+
+	a, err := NewAgent(config, l, TcpDialer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go a.Wait()
+	defer a.Close()
+
+	assert.Equal(t, addressFamilyUnspec, resolveTypeOf(a.marshaller.Address))
+
+	// b replies to the hostname a advertises
+	s, err := a.Establish(b.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	_, ok := b.peers.Load(config.ListenEndpoint)
+	assert.True(t, ok)
+}
+
+func TestAgentSessions(t *testing.T) {
+	p := &partition{}
+
+	var config AgentConfig
+	config.SetDefault()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := NewAgent(config, l, p.dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go a.Wait()
+	defer a.Close()
+
+	b := newTestAgent(t)
+	c := newTestAgent(t)
+
+	assert.Empty(t, a.Sessions())
+
+	sb, err := a.Establish(b.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = a.Establish(c.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(t, sb.Ping(ctx))
+
+	meta := sb.Meta()
+	assert.Equal(t, a.LocalInstance, meta.LocalInstance)
+	assert.Equal(t, b.LocalInstance, meta.RemoteInstance)
+	assert.Equal(t, sb.(*leaseSession).localInstance, meta.LeaseInstance)
+	assert.Equal(t, b.Addr().String(), meta.RemoteEndpoint)
+	assert.Equal(t, LeaseAgentStateOpen, meta.State)
+	assert.Equal(t, config.LeaseDuration, meta.LeaseDuration)
+	assert.Equal(t, sb.LeaseExpiry(), meta.LeaseExpiry)
+	assert.Equal(t, sb.LastPongTime(), meta.LastPongTime)
+	assert.Greater(t, int64(meta.LastPingRTT), int64(0))
+	assert.Zero(t, meta.MissedPings)
+	assert.Empty(t, meta.Arbitrations)
+
+	all := a.Sessions()
+	if assert.Len(t, all, 2) {
+		assert.Less(t, all[0].RemoteEndpoint, all[1].RemoteEndpoint)
+
+		remotes := map[string]int64{}
+		for _, m := range all {
+			remotes[m.RemoteEndpoint] = m.RemoteInstance
+		}
+		assert.Equal(t, map[string]int64{
+			b.Addr().String(): b.LocalInstance,
+			c.Addr().String(): c.LocalInstance,
+		}, remotes)
+	}
+
+	// pings dropped on the way count as missed until a pong arrives
+	atomic.StoreInt32(&p.blocked, 1)
+	for i := 0; i < 2; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		assert.Error(t, sb.Ping(ctx))
+		cancel()
+	}
+	assert.Equal(t, uint64(2), sb.Meta().MissedPings)
+
+	atomic.StoreInt32(&p.blocked, 0)
+	assert.NoError(t, sb.Ping(ctx))
+	assert.Zero(t, sb.Meta().MissedPings)
+}
@@ -0,0 +1,173 @@
+package lease
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+type ArbitrationResult int32
+
+const (
+	// ArbitrationResultKeep the requester survives, the remote side is declared failed
+	ArbitrationResultKeep ArbitrationResult = iota
+	// ArbitrationResultFail the requester must go down
+	ArbitrationResultFail
+)
+
+func (r ArbitrationResult) String() string {
+	switch r {
+	case ArbitrationResultKeep:
+		return "Keep"
+	case ArbitrationResultFail:
+		return "Fail"
+	}
+
+	return fmt.Sprintf("ArbitrationResult(%d)", int32(r))
+}
+
+// ArbitrationRequest reports an expired lease between the local and the remote agent
+type ArbitrationRequest struct {
+	LocalEndpoint  string
+	LocalInstance  int64
+	RemoteEndpoint string
+	RemoteInstance int64
+	LeaseDuration  time.Duration
+}
+
+type ArbitrationReply struct {
+	Result ArbitrationResult
+}
+
+// ArbitrationRecord is one arbitration of a session, Error is set if the arbitrator could not be reached
+type ArbitrationRecord struct {
+	Time           time.Time
+	RemoteInstance int64
+	Result         ArbitrationResult
+	Error          string
+}
+
+// maxArbitrationRecords bounds the history kept per session
+const maxArbitrationRecords = 16
+
+func (s *leaseSession) recordArbitration(r ArbitrationRecord) {
+	s.objLock.Lock()
+	defer s.objLock.Unlock()
+
+	s.arbitrations = append(s.arbitrations, r)
+	if len(s.arbitrations) > maxArbitrationRecords {
+		s.arbitrations = s.arbitrations[len(s.arbitrations)-maxArbitrationRecords:]
+	}
+}
+
+// Arbitrator decides which side of an expired lease survives, in a cluster this is done by neighbor nodes
+type Arbitrator interface {
+	Arbitrate(ctx context.Context, req *ArbitrationRequest) (*ArbitrationReply, error)
+}
+
+var ErrArbitrationLost = errors.New("lease arbitration lost")
+
+// LocalArbitrator is an in-process arbitrator, the first side reporting an expired lease survives.
+// A failed agent instance never wins again, it has to restart with a new instance.
+type LocalArbitrator struct {
+	lock   sync.Mutex
+	failed map[arbitrationSubject]bool
+}
+
+// arbitrationSubject is an agent instance at an endpoint, instances are only unique per endpoint
+type arbitrationSubject struct {
+	endpoint string
+	instance int64
+}
+
+func NewLocalArbitrator() *LocalArbitrator {
+	return &LocalArbitrator{
+		failed: make(map[arbitrationSubject]bool),
+	}
+}
+
+func (l *LocalArbitrator) Arbitrate(ctx context.Context, req *ArbitrationRequest) (*ArbitrationReply, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.failed[arbitrationSubject{req.LocalEndpoint, req.LocalInstance}] {
+		return &ArbitrationReply{Result: ArbitrationResultFail}, nil
+	}
+
+	l.failed[arbitrationSubject{req.RemoteEndpoint, req.RemoteInstance}] = true
+	return &ArbitrationReply{Result: ArbitrationResultKeep}, nil
+}
+
+// defaultArbitrationTimeout bounds arbitration when neither side configures it
+const defaultArbitrationTimeout = 2 * time.Second
+
+// arbitrationTimeout must be called with objLock held.
+// It is ArbitrationTimeout if set, otherwise the arbitration duration negotiated with the remote,
+// capped at LeaseSuspendTimeout as the session fails once the suspend window passes.
+func (s *leaseSession) arbitrationTimeout() time.Duration {
+	timeout := s.parent.config.ArbitrationTimeout
+	if timeout <= 0 {
+		timeout = s.arbitrationDuration
+	}
+
+	suspend := s.parent.config.LeaseSuspendTimeout
+	if timeout <= 0 || (suspend > 0 && timeout > suspend) {
+		timeout = suspend
+	}
+
+	if timeout <= 0 {
+		return defaultArbitrationTimeout
+	}
+
+	return timeout
+}
+
+func (s *leaseSession) arbitrate() {
+	a := s.parent
+
+	s.objLock.Lock()
+	timeout := s.arbitrationTimeout()
+	req := ArbitrationRequest{
+		LocalEndpoint:  a.endpoint,
+		LocalInstance:  a.LocalInstance,
+		RemoteEndpoint: s.addr,
+		RemoteInstance: s.remoteInstance,
+		LeaseDuration:  s.duration,
+	}
+	s.objLock.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	reply, err := a.config.Arbitrator.Arbitrate(ctx, &req)
+
+	record := ArbitrationRecord{
+		Time:           time.Now(),
+		RemoteInstance: req.RemoteInstance,
+		Result:         ArbitrationResultFail,
+	}
+	if err != nil {
+		record.Error = err.Error()
+	} else {
+		record.Result = reply.Result
+	}
+	s.recordArbitration(record)
+
+	if err != nil {
+		// cannot prove the remote is gone, go down to be safe
+		a.fail(fmt.Errorf("lease arbitration with %v failed: %w", s.addr, err))
+		s.setState(LeaseAgentStateFailed)
+		return
+	}
+
+	a.logger.Info("lease arbitration done", "endpoint", s.addr, "result", reply.Result)
+
+	if reply.Result == ArbitrationResultFail {
+		a.fail(ErrArbitrationLost)
+	}
+
+	// either the remote or the local agent is gone, the lease is over
+	s.setState(LeaseAgentStateFailed)
+}
@@ -0,0 +1,181 @@
+package lease
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// partition drops everything written while blocked, as if the network between agents is gone
+type partition struct {
+	blocked int32
+}
+
+type partitionConn struct {
+	net.Conn
+	p *partition
+}
+
+func (c *partitionConn) Write(b []byte) (int, error) {
+	if atomic.LoadInt32(&c.p.blocked) == 1 {
+		return len(b), nil
+	}
+
+	return c.Conn.Write(b)
+}
+
+func (p *partition) dial(addr string) (net.Conn, error) {
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &partitionConn{Conn: c, p: p}, nil
+}
+
+func TestArbitrationPartition(t *testing.T) {
+	t.Run("loopback", func(t *testing.T) { testArbitrationPartition(t, "127.0.0.1") })
+	// the arbitration keys are the advertised endpoints, not the bound ones
+	t.Run("wildcard", func(t *testing.T) { testArbitrationPartition(t, "0.0.0.0") })
+}
+
+func testArbitrationPartition(t *testing.T, bind string) {
+	p := &partition{}
+	failed := make(chan *Agent, 2)
+
+	var config AgentConfig
+	config.SetDefault()
+	config.LeaseDuration = 300 * time.Millisecond
+	config.Arbitrator = NewLocalArbitrator()
+	config.FailedCallback = func(a *Agent, err error) {
+		assert.ErrorIs(t, err, ErrArbitrationLost)
+		failed <- a
+	}
+
+	newAgent := func() *Agent {
+		l, err := net.Listen("tcp", net.JoinHostPort(bind, "0"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		config := config
+		config.ListenEndpoint = net.JoinHostPort("127.0.0.1", strconv.Itoa(l.Addr().(*net.TCPAddr).Port))
+
+		a, err := NewAgent(config, l, p.dial)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go a.Wait()
+		t.Cleanup(func() { a.Close() })
+
+		return a
+	}
+
+	a := newAgent()
+	b := newAgent()
+
+	sa, err := a.Establish(b.endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sb, err := b.Establish(a.endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	atomic.StoreInt32(&p.blocked, 1)
+
+	assert.Eventually(t, func() bool {
+		return sa.State() == LeaseAgentStateFailed && sb.State() == LeaseAgentStateFailed
+	}, 5*time.Second, 50*time.Millisecond)
+
+	var loser *Agent
+	select {
+	case loser = <-failed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no agent lost the arbitration")
+	}
+	assert.Contains(t, []*Agent{a, b}, loser)
+
+	// exactly one side goes down
+	select {
+	case <-failed:
+		t.Fatal("both agents failed")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	winner := a
+	if loser == a {
+		winner = b
+	}
+
+	assert.Equal(t, LeaseAgentStateFailed, loser.State())
+	assert.ErrorIs(t, loser.Err(), ErrArbitrationLost)
+	assert.Equal(t, LeaseAgentStateOpen, winner.State())
+	assert.NoError(t, winner.Err())
+
+	results := map[ArbitrationResult]int{}
+	for _, s := range []Session{sa, sb} {
+		history := s.Meta().Arbitrations
+		if assert.Len(t, history, 1) {
+			assert.Empty(t, history[0].Error)
+			results[history[0].Result]++
+		}
+	}
+	assert.Equal(t, map[ArbitrationResult]int{ArbitrationResultKeep: 1, ArbitrationResultFail: 1}, results)
+}
+
+func TestLocalArbitrator(t *testing.T) {
+	arb := NewLocalArbitrator()
+
+	arbitrate := func(local string, localInstance int64, remote string, remoteInstance int64) ArbitrationResult {
+		r, err := arb.Arbitrate(context.Background(), &ArbitrationRequest{
+			LocalEndpoint:  local,
+			LocalInstance:  localInstance,
+			RemoteEndpoint: remote,
+			RemoteInstance: remoteInstance,
+		})
+		assert.NoError(t, err)
+		return r.Result
+	}
+
+	assert.Equal(t, ArbitrationResultKeep, arbitrate("a:1", 1, "b:1", 2))
+	assert.Equal(t, ArbitrationResultFail, arbitrate("b:1", 2, "a:1", 1))
+
+	// a restarted agent has a new instance
+	assert.Equal(t, ArbitrationResultKeep, arbitrate("b:1", 3, "a:1", 1))
+
+	// same instance at another endpoint is another agent
+	assert.Equal(t, ArbitrationResultKeep, arbitrate("c:1", 2, "a:1", 1))
+}
+
+func TestArbitrationTimeout(t *testing.T) {
+	a := &Agent{}
+	s := &leaseSession{parent: a}
+
+	assert.Equal(t, defaultArbitrationTimeout, s.arbitrationTimeout())
+
+	// nothing suspends the session
+	s.arbitrationDuration = 3 * time.Second
+	assert.Equal(t, 3*time.Second, s.arbitrationTimeout())
+
+	a.config.ArbitrationTimeout = 5 * time.Second
+	assert.Equal(t, 5*time.Second, s.arbitrationTimeout())
+
+	// capped at the suspend window
+	a.config.LeaseSuspendTimeout = 2 * time.Second
+	assert.Equal(t, 2*time.Second, s.arbitrationTimeout())
+
+	a.config.ArbitrationTimeout = time.Second
+	assert.Equal(t, time.Second, s.arbitrationTimeout())
+
+	a.config.ArbitrationTimeout = 0
+	s.arbitrationDuration = 0
+	assert.Equal(t, 2*time.Second, s.arbitrationTimeout())
+}
@@ -15,19 +15,26 @@ const (
 	LeaseMessageTypeRelayResponse
 )
 
+// RelationshipIdentifier is a lease relationship between a local and a remote application
+type RelationshipIdentifier struct {
+	Local  string
+	Remote string
+}
+
 type messageBody struct {
-	SubjectEstablishPendingList  []string
-	SubjectFailedPendingList     []string
-	MonitorFailedPendingList     []string
-	SubjectPendingAcceptedList   []string
-	SubjectPendingRejectedList   []string
-	SubjectFailedAcceptedList    []string
-	MonitorFailedAcceptedList    []string
-	SubjectTerminatePendingList  []string
-	SubjectTerminateAcceptedList []string
+	SubjectEstablishPendingList  []RelationshipIdentifier
+	SubjectFailedPendingList     []RelationshipIdentifier
+	MonitorFailedPendingList     []RelationshipIdentifier
+	SubjectPendingAcceptedList   []RelationshipIdentifier
+	SubjectPendingRejectedList   []RelationshipIdentifier
+	SubjectFailedAcceptedList    []RelationshipIdentifier
+	MonitorFailedAcceptedList    []RelationshipIdentifier
+	SubjectTerminatePendingList  []RelationshipIdentifier
+	SubjectTerminateAcceptedList []RelationshipIdentifier
 }
 
 type Message struct {
+	// Identifier is generated when marshalling if zero
 	Identifier               int64
 	Type                     LeaseMessageType
 	LeaseInstance            int64
@@ -37,6 +44,10 @@ type Message struct {
 	LeaseSuspendDuration     time.Duration
 	ArbitrationDuration      time.Duration
 	IsTwoWayTermination      bool
-	MessageListenEndpoint    string
+	// LeaseAgentInstance is the sender agent instance from the message extension, zero if absent
+	LeaseAgentInstance    int64
+	MessageListenEndpoint string
+	// LeaseListenEndpoint is the other end of the lease on forward and relay messages
+	LeaseListenEndpoint string
 	messageBody
 }
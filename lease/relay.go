@@ -0,0 +1,150 @@
+package lease
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/tg123/phabrik/common"
+)
+
+// Forwarding a lease request from A to B through relay R:
+//
+//	A -> R ForwardRequest  LeaseListenEndpoint=B
+//	R -> B RelayRequest    LeaseListenEndpoint=A
+//	B -> R RelayResponse   LeaseListenEndpoint=A
+//	R -> A ForwardResponse LeaseListenEndpoint=B
+//
+// MessageListenEndpoint is always the sender of a hop.
+
+// forward sends the lease request through the relays in turn until one of them answers,
+// each relay gets an equal share of the lease duration to answer.
+// forward must be called with leaseLock held.
+func (s *leaseSession) forward(ctx context.Context, req *Message, match func(*Message) bool) (*Message, error) {
+	relays := s.parent.config.RelayEndpoints
+	if len(relays) == 0 {
+		return nil, fmt.Errorf("no relay for %v", s.addr)
+	}
+
+	m := *req
+	m.Type = LeaseMessageTypeForwardRequest
+	m.LeaseListenEndpoint = s.addr
+
+	timeout := s.parent.leaseDuration() / time.Duration(len(relays))
+
+	err := fmt.Errorf("no relay for %v", s.addr)
+	for _, relay := range relays {
+		if relay == s.addr {
+			continue
+		}
+
+		if err = s.parent.send(relay, &m); err != nil {
+			s.parent.logger.Debug("lease forward failed", "relay", relay, "endpoint", s.addr, common.LogKeyError, err)
+			continue
+		}
+
+		relayCtx, cancel := context.WithTimeout(ctx, timeout)
+		var reply *Message
+		reply, err = s.wait(relayCtx, match)
+		cancel()
+
+		if err == nil {
+			return reply, nil
+		}
+
+		// the caller gave up or the session is gone, no point in asking the next relay
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		if relayCtx.Err() == nil {
+			return nil, err
+		}
+
+		s.parent.logger.Debug("lease forward unanswered", "relay", relay, "endpoint", s.addr, "timeout", timeout)
+	}
+
+	return nil, err
+}
+
+// relayPair is a forwarded request, only responses of pairs forwarded within a lease duration are passed back
+type relayPair struct {
+	origin string
+	target string
+}
+
+// relayAllowed tells whether forwarding to target is allowed in relay role
+func (a *Agent) relayAllowed(target string) bool {
+	if !a.config.Relay {
+		return false
+	}
+
+	for _, t := range a.config.RelayTargets {
+		if t == target {
+			return true
+		}
+	}
+
+	_, ok := a.sessions.Load(target)
+	return ok
+}
+
+func (a *Agent) rememberRelay(p relayPair) {
+	now := time.Now()
+	a.relayed.Range(func(key, value interface{}) bool {
+		if now.Sub(value.(time.Time)) > a.leaseDuration() {
+			a.relayed.Delete(key)
+		}
+		return true
+	})
+
+	a.relayed.Store(p, now)
+}
+
+func (a *Agent) relayedRecently(p relayPair) bool {
+	v, ok := a.relayed.Load(p)
+	return ok && time.Since(v.(time.Time)) <= a.leaseDuration()
+}
+
+func (a *Agent) onRelayMessage(m *Message) error {
+	if m.LeaseListenEndpoint == "" {
+		return fmt.Errorf("%v without lease listen endpoint", m.Type)
+	}
+
+	switch m.Type {
+	case LeaseMessageTypeForwardRequest:
+		if !a.relayAllowed(m.LeaseListenEndpoint) {
+			return fmt.Errorf("relay from %v to %v not allowed", m.MessageListenEndpoint, m.LeaseListenEndpoint)
+		}
+
+		a.rememberRelay(relayPair{origin: m.MessageListenEndpoint, target: m.LeaseListenEndpoint})
+
+		// relay role, pass to the target
+		relay := *m
+		relay.Type = LeaseMessageTypeRelayRequest
+		relay.LeaseListenEndpoint = m.MessageListenEndpoint
+		return a.send(m.LeaseListenEndpoint, &relay)
+	case LeaseMessageTypeRelayRequest:
+		// target role, answer the originator through the relay
+		req := *m
+		req.Type = LeaseMessageTypeLeaseRequest
+		req.MessageListenEndpoint = m.LeaseListenEndpoint
+
+		reply := a.leaseResponse(&req)
+		reply.Type = LeaseMessageTypeRelayResponse
+		reply.LeaseListenEndpoint = m.LeaseListenEndpoint
+		return a.send(m.MessageListenEndpoint, reply)
+	case LeaseMessageTypeRelayResponse:
+		if !a.relayedRecently(relayPair{origin: m.LeaseListenEndpoint, target: m.MessageListenEndpoint}) {
+			return fmt.Errorf("relay response from %v to %v was not requested", m.MessageListenEndpoint, m.LeaseListenEndpoint)
+		}
+
+		// relay role, pass the response back to the originator
+		forward := *m
+		forward.Type = LeaseMessageTypeForwardResponse
+		forward.LeaseListenEndpoint = m.MessageListenEndpoint
+		return a.send(m.LeaseListenEndpoint, &forward)
+	}
+
+	return fmt.Errorf("unexpected relay message type %v", m.Type)
+}
@@ -0,0 +1,165 @@
+package lease
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// blockingDialer refuses to dial blocked addresses, all other addresses are dialed over tcp
+type blockingDialer struct {
+	lock    sync.Mutex
+	blocked map[string]bool
+}
+
+func (d *blockingDialer) block(addr string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.blocked[addr] = true
+}
+
+func (d *blockingDialer) dial(addr string) (net.Conn, error) {
+	d.lock.Lock()
+	blocked := d.blocked[addr]
+	d.lock.Unlock()
+
+	if blocked {
+		return nil, fmt.Errorf("%v unreachable", addr)
+	}
+
+	return TcpDialer(addr)
+}
+
+func TestAgentRelay(t *testing.T) {
+	var config AgentConfig
+	config.SetDefault()
+	config.LeaseDuration = 300 * time.Millisecond
+
+	b := newTestAgentWithConfig(t, config)
+
+	relayConfig := config
+	relayConfig.Relay = true
+	relayConfig.RelayTargets = []string{b.Addr().String()}
+	r := newTestAgentWithConfig(t, relayConfig)
+
+	d := &blockingDialer{blocked: make(map[string]bool)}
+	d.block(b.Addr().String())
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config.RelayEndpoints = []string{b.Addr().String(), r.Addr().String()}
+	a, err := NewAgent(config, l, d.dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go a.Wait()
+	defer a.Close()
+
+	s, err := a.Establish(b.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	assert.Equal(t, b.LocalInstance, s.(*leaseSession).RemoteInstance())
+	assert.Equal(t, LeaseAgentStateOpen, s.State())
+
+	// renewals keep going through the relay
+	expiry := s.LeaseExpiry()
+	assert.Eventually(t, func() bool {
+		return s.LeaseExpiry().After(expiry)
+	}, 2*time.Second, 50*time.Millisecond)
+
+	t.Run("no relay", func(t *testing.T) {
+		config.RelayEndpoints = nil
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c, err := NewAgent(config, l, d.dial)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+
+		_, err = c.Establish(b.Addr().String())
+		assert.Error(t, err)
+	})
+
+	t.Run("relay not allowed", func(t *testing.T) {
+		// c is not configured as relay
+		c := newTestAgentWithConfig(t, config)
+		config.RelayEndpoints = []string{c.Addr().String()}
+
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		e, err := NewAgent(config, l, d.dial)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go e.Wait()
+		defer e.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+
+		_, err = e.EstablishContext(ctx, b.Addr().String())
+		assert.Error(t, err)
+
+		// target not allowed on r
+		assert.Error(t, r.onRelayMessage(&Message{
+			Type:                  LeaseMessageTypeForwardRequest,
+			MessageListenEndpoint: e.Addr().String(),
+			LeaseListenEndpoint:   c.Addr().String(),
+		}))
+
+		// response without forwarded request
+		assert.Error(t, r.onRelayMessage(&Message{
+			Type:                  LeaseMessageTypeRelayResponse,
+			MessageListenEndpoint: b.Addr().String(),
+			LeaseListenEndpoint:   e.Addr().String(),
+		}))
+	})
+
+	t.Run("fall back to next relay", func(t *testing.T) {
+		// c refuses to relay, r answers
+		c := newTestAgentWithConfig(t, config)
+		config.RelayEndpoints = []string{c.Addr().String(), r.Addr().String()}
+
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		e, err := NewAgent(config, l, d.dial)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go e.Wait()
+		defer e.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+
+		s, err := e.EstablishContext(ctx, b.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		assert.Equal(t, LeaseAgentStateOpen, s.State())
+	})
+}
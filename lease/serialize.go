@@ -8,7 +8,6 @@ import (
 	"math"
 	"net"
 	"strconv"
-	"syscall"
 	"time"
 	"unicode/utf16"
 )
@@ -49,15 +48,26 @@ type leaseMessageHeader struct {
 	SubjectTerminatePendingList  listDesc
 	SubjectTerminateAcceptedList listDesc
 	MessageListenEndpoint        listDesc
-	_                            uint32
-	// LeaseListenEndPoint          leaseMessageBodyList
+	// LeaseListenEndpoint is only set on forward and relay messages.
+	// Its place in the header, growing it from 200 to 208 bytes, is not verified against a native capture.
+	LeaseListenEndpoint listDesc
 }
 
 type leaseMessageExt struct {
 	MsgLeaseAgentInstance uint64
 }
 
-var sizeofLeaseMessageHeader = uint32(binary.Size(leaseMessageHeader{}))
+var (
+	sizeofLeaseMessageHeader = uint32(binary.Size(leaseMessageHeader{}))
+	sizeofLeaseMessageExt    = uint32(binary.Size(leaseMessageExt{}))
+)
+
+// the major version changes the wire layout, minor versions only append,
+// newer minor versions are decoded as far as known
+const (
+	leaseMessageMajorVersion = 2
+	leaseMessageMinorVersion = 1
+)
 
 type listDesc struct {
 	Count       uint32
@@ -65,17 +75,58 @@ type listDesc struct {
 	Size        uint32
 }
 
-type relationshipIdentifier struct {
-	Local  string
-	Remote string
-}
+// address families sent by us are the windows values unless AddressFamilyInet6 is configured,
+// received families are opaque as linux nodes send their own values, e.g. AF_INET6 is 10
+const (
+	addressFamilyUnspec uint16 = 0
+	addressFamilyInet   uint16 = 2
+	addressFamilyInet6  uint16 = 23
+)
 
+// transportListenEndpoint is the native TRANSPORT_LISTEN_ENDPOINT,
+// Address is an ip or a hostname resolved according to ResolveType
 type transportListenEndpoint struct {
 	Address     string
 	ResolveType uint16
 	Port        uint16
 }
 
+// resolveTypeOf returns the address family for ip literals, hostnames resolve to any family
+func resolveTypeOf(host string) uint16 {
+	ip := net.ParseIP(host)
+
+	switch {
+	case ip == nil:
+		return addressFamilyUnspec
+	case ip.To4() != nil:
+		return addressFamilyInet
+	default:
+		return addressFamilyInet6
+	}
+}
+
+func parseListenEndpoint(endpoint string) (transportListenEndpoint, error) {
+	host, port, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return transportListenEndpoint{}, err
+	}
+
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return transportListenEndpoint{}, err
+	}
+
+	return transportListenEndpoint{
+		Address:     host,
+		ResolveType: resolveTypeOf(host),
+		Port:        uint16(p),
+	}, nil
+}
+
+func (e *transportListenEndpoint) String() string {
+	return net.JoinHostPort(e.Address, strconv.Itoa(int(e.Port)))
+}
+
 // cannot call binary.Size
 func marshalWithSize(w io.Writer, d interface{}) (uint32, error) {
 	var b []byte
@@ -104,7 +155,7 @@ func marshalWithSize(w io.Writer, d interface{}) (uint32, error) {
 	return size + uint32(binary.Size(uint32(1))), nil
 }
 
-func marshalRelationshipList(w io.Writer, l []relationshipIdentifier) (uint32, error) {
+func marshalRelationshipList(w io.Writer, l []RelationshipIdentifier) (uint32, error) {
 	var buf bytes.Buffer
 	if err := binary.Write(&buf, binary.LittleEndian, uint32(len(l))); err != nil {
 		return 0, err
@@ -123,16 +174,119 @@ func marshalRelationshipList(w io.Writer, l []relationshipIdentifier) (uint32, e
 	return marshalWithSize(w, buf.Bytes())
 }
 
-func dataAtList(data []byte, desc *listDesc) ([]byte, error) {
-	st := desc.StartOffset
-	ed := desc.StartOffset + desc.Size
+func unmarshalWithSize(r *bytes.Reader) ([]byte, error) {
+	var size uint32
+	if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+		return nil, err
+	}
+
+	// the size comes from the wire, check it before allocating
+	if size > uint32(r.Len()) {
+		return nil, fmt.Errorf("size %v beyond remaining %v bytes", size, r.Len())
+	}
+
+	b := make([]byte, size)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+func unmarshalString(r *bytes.Reader) (string, error) {
+	b, err := unmarshalWithSize(r)
+	if err != nil {
+		return "", err
+	}
+
+	if len(b)%sizeofUint16 != 0 {
+		return "", fmt.Errorf("bad utf16 string size %v", len(b))
+	}
+
+	s := make([]uint16, len(b)/sizeofUint16)
+	if err := binary.Read(bytes.NewReader(b), binary.LittleEndian, s); err != nil {
+		return "", err
+	}
+
+	return string(utf16.Decode(s)), nil
+}
+
+func unmarshalRelationshipList(data []byte, headerSize uint32, desc *listDesc) ([]RelationshipIdentifier, error) {
+	if desc.Size == 0 {
+		return nil, nil
+	}
+
+	d, err := dataAtList(data, headerSize, desc)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := unmarshalWithSize(bytes.NewReader(d))
+	if err != nil {
+		return nil, err
+	}
+
+	r := bytes.NewReader(b)
+
+	var count uint32
+	if err := binary.Read(r, binary.LittleEndian, &count); err != nil {
+		return nil, err
+	}
+
+	if count != desc.Count {
+		return nil, fmt.Errorf("list count mismatch, header %v, body %v", desc.Count, count)
+	}
+
+	var l []RelationshipIdentifier
+	for i := uint32(0); i < count; i++ {
+		local, err := unmarshalString(r)
+		if err != nil {
+			return nil, err
+		}
+
+		remote, err := unmarshalString(r)
+		if err != nil {
+			return nil, err
+		}
+
+		l = append(l, RelationshipIdentifier{Local: local, Remote: remote})
+	}
+
+	return l, nil
+}
+
+type bodyList struct {
+	listDesc *listDesc
+	list     *[]RelationshipIdentifier
+}
+
+// bodyLists pairs header list descriptors with body lists in the order the lists are written to the body,
+// which is not the header field order: SubjectPendingRejectedList is written before the failed accepted lists
+func bodyLists(header *leaseMessageHeader, body *messageBody) []bodyList {
+	return []bodyList{
+		{&header.SubjectEstablishPendingList, &body.SubjectEstablishPendingList},
+		{&header.SubjectFailedPendingList, &body.SubjectFailedPendingList},
+		{&header.MonitorFailedPendingList, &body.MonitorFailedPendingList},
+		{&header.SubjectPendingAcceptedList, &body.SubjectPendingAcceptedList},
+		{&header.SubjectPendingRejectedList, &body.SubjectPendingRejectedList},
+		{&header.SubjectFailedAcceptedList, &body.SubjectFailedAcceptedList},
+		{&header.MonitorFailedAcceptedList, &body.MonitorFailedAcceptedList},
+		{&header.SubjectTerminatePendingList, &body.SubjectTerminatePendingList},
+		{&header.SubjectTerminateAcceptedList, &body.SubjectTerminateAcceptedList},
+	}
+}
+
+// dataAtList returns the body bytes of a list, lists never overlap the header
+func dataAtList(data []byte, headerSize uint32, desc *listDesc) ([]byte, error) {
+	st := uint64(desc.StartOffset)
+	ed := st + uint64(desc.Size)
 
-	if st >= uint32(len(data)) {
-		return nil, fmt.Errorf("bad data start offset")
+	if st < uint64(headerSize) || st > uint64(len(data)) {
+		return nil, fmt.Errorf("bad data start offset %v", desc.StartOffset)
 	}
 
-	if ed >= uint32(len(data)) {
-		return nil, fmt.Errorf("bad data start offset")
+	if ed > uint64(len(data)) {
+		return nil, fmt.Errorf("bad data end offset %v", ed)
 	}
 
 	return data[st:ed], nil
@@ -144,6 +298,58 @@ const (
 	sizeofUShort        = 2
 )
 
+func unmarshalEndpoint(d []byte) (transportListenEndpoint, error) {
+	var ep transportListenEndpoint
+
+	if len(d) < sizeofUint16+sizeofAddressFamily+sizeofUShort || len(d)%sizeofUint16 != 0 {
+		return ep, fmt.Errorf("bad endpoint size %v", len(d))
+	}
+
+	r := bytes.NewReader(d)
+	s := make([]uint16, (len(d)-sizeofAddressFamily-sizeofUShort)/sizeofUint16)
+	if err := binary.Read(r, binary.LittleEndian, s); err != nil {
+		return ep, err
+	}
+
+	if s[len(s)-1] == 0 {
+		s = s[:len(s)-1]
+	}
+
+	if err := binary.Read(r, binary.LittleEndian, &ep.ResolveType); err != nil {
+		return ep, err
+	}
+
+	if err := binary.Read(r, binary.LittleEndian, &ep.Port); err != nil {
+		return ep, err
+	}
+
+	ep.Address = string(utf16.Decode(s))
+
+	return ep, nil
+}
+
+func marshalEndpoint(w io.Writer, ep *transportListenEndpoint) (uint32, error) {
+	s := []rune(ep.Address)
+	s = append(s, 0)
+	ss := utf16.Encode(s)
+
+	size := uint32(len(ss) * sizeofUint16)
+
+	if err := binary.Write(w, binary.LittleEndian, ss); err != nil {
+		return 0, err
+	}
+
+	if err := binary.Write(w, binary.LittleEndian, ep.ResolveType); err != nil {
+		return 0, err
+	}
+
+	if err := binary.Write(w, binary.LittleEndian, ep.Port); err != nil {
+		return 0, err
+	}
+
+	return size + sizeofAddressFamily + sizeofUShort, nil
+}
+
 func unmarshal(data []byte) (*Message, error) {
 	header := leaseMessageHeader{}
 
@@ -151,6 +357,20 @@ func unmarshal(data []byte) (*Message, error) {
 		return nil, err
 	}
 
+	if header.MajorVersion != leaseMessageMajorVersion {
+		return nil, fmt.Errorf("unsupported lease message version %v.%v", header.MajorVersion, header.MinorVersion)
+	}
+
+	if header.MessageHeaderSize < sizeofLeaseMessageHeader || header.MessageHeaderSize > header.MessageSize {
+		return nil, fmt.Errorf("bad lease message header size %v", header.MessageHeaderSize)
+	}
+
+	if header.MessageSize > uint32(len(data)) {
+		return nil, fmt.Errorf("lease message size %v larger than data %v", header.MessageSize, len(data))
+	}
+
+	data = data[:header.MessageSize]
+
 	message := Message{}
 
 	message.Type = header.MessageType
@@ -163,34 +383,46 @@ func unmarshal(data []byte) (*Message, error) {
 	message.ArbitrationDuration = time.Duration(header.ArbitrationDuration) * time.Millisecond
 	message.IsTwoWayTermination = header.IsTwoWayTermination
 
-	// TODO body list
-	{
-		d, err := dataAtList(data, &header.MessageListenEndpoint)
-		if err != nil {
+	// extension follows the header when the sender included it
+	if header.MessageHeaderSize >= sizeofLeaseMessageHeader+sizeofLeaseMessageExt {
+		var ext leaseMessageExt
+		if err := binary.Read(bytes.NewReader(data[sizeofLeaseMessageHeader:]), binary.LittleEndian, &ext); err != nil {
 			return nil, err
 		}
 
-		r := bytes.NewReader(d)
-		s := make([]uint16, (header.MessageListenEndpoint.Size-sizeofAddressFamily-sizeofUShort)/sizeofUint16)
-		if err := binary.Read(r, binary.LittleEndian, s); err != nil {
+		message.LeaseAgentInstance = int64(ext.MsgLeaseAgentInstance)
+	}
+
+	for _, d := range bodyLists(&header, &message.messageBody) {
+		l, err := unmarshalRelationshipList(data, header.MessageHeaderSize, d.listDesc)
+		if err != nil {
 			return nil, err
 		}
 
-		if s[len(s)-1] == 0 {
-			s = s[:len(s)-1]
-		}
+		*d.list = l
+	}
 
-		// skip address family
-		if _, err := r.Seek(sizeofAddressFamily, io.SeekCurrent); err != nil {
+	{
+		d, err := dataAtList(data, header.MessageHeaderSize, &header.MessageListenEndpoint)
+		if err != nil {
 			return nil, err
 		}
 
-		var port uint16
-		if err := binary.Read(r, binary.LittleEndian, &port); err != nil {
+		ep, err := unmarshalEndpoint(d)
+		if err != nil {
 			return nil, err
 		}
 
-		message.MessageListenEndpoint = net.JoinHostPort(string(utf16.Decode(s)), strconv.Itoa(int(port)))
+		message.MessageListenEndpoint = ep.String()
+	}
+
+	// optional, a lease listen endpoint which cannot be parsed is ignored
+	if header.LeaseListenEndpoint.Size > 0 {
+		if d, err := dataAtList(data, header.MessageHeaderSize, &header.LeaseListenEndpoint); err == nil {
+			if ep, err := unmarshalEndpoint(d); err == nil {
+				message.LeaseListenEndpoint = ep.String()
+			}
+		}
 	}
 
 	return &message, nil
@@ -200,33 +432,36 @@ type marshalContext struct {
 	AppId   string
 	Address string
 	Port    uint16
+	// LeaseAgentInstance is sent in the message extension unless set on the message
+	LeaseAgentInstance int64
+	// AddressFamilyInet6 is sent as resolve type of ipv6 endpoints, addressFamilyInet6 if 0
+	AddressFamilyInet6 uint16
 }
 
-func (m *marshalContext) marshalLeaseBody(header *leaseMessageHeader, body *messageBody) ([]byte, error) {
-
-	type param struct {
-		listDesc *listDesc
-		list     []string
+// resolveType is resolveTypeOf with the ipv6 family the peers expect
+func (m *marshalContext) resolveType(host string) uint16 {
+	t := resolveTypeOf(host)
+	if t == addressFamilyInet6 && m.AddressFamilyInet6 != 0 {
+		return m.AddressFamilyInet6
 	}
 
+	return t
+}
+
+func (m *marshalContext) marshalLeaseBody(header *leaseMessageHeader, body *messageBody, leaseListenEndpoint string) ([]byte, error) {
+
 	var buf bytes.Buffer
-	offset := uint32(binary.Size(header))
-
-	for _, d := range []param{
-		{&header.SubjectEstablishPendingList, body.SubjectEstablishPendingList},
-		{&header.SubjectFailedPendingList, body.SubjectFailedPendingList},
-		{&header.MonitorFailedPendingList, body.MonitorFailedPendingList},
-		{&header.SubjectPendingAcceptedList, body.SubjectPendingAcceptedList},
-		{&header.SubjectPendingRejectedList, body.SubjectPendingRejectedList},
-		{&header.SubjectFailedAcceptedList, body.SubjectFailedAcceptedList},
-		{&header.MonitorFailedAcceptedList, body.MonitorFailedAcceptedList},
-		{&header.SubjectTerminatePendingList, body.SubjectTerminatePendingList},
-		{&header.SubjectTerminateAcceptedList, body.SubjectTerminateAcceptedList},
-	} {
-		var l []relationshipIdentifier
-
-		for _, r := range d.list {
-			l = append(l, relationshipIdentifier{m.AppId, r})
+	offset := header.MessageHeaderSize
+
+	for _, d := range bodyLists(header, body) {
+		var l []RelationshipIdentifier
+
+		for _, r := range *d.list {
+			if r.Local == "" {
+				r.Local = m.AppId
+			}
+
+			l = append(l, r)
 		}
 
 		size, err := marshalRelationshipList(&buf, l)
@@ -243,37 +478,54 @@ func (m *marshalContext) marshalLeaseBody(header *leaseMessageHeader, body *mess
 
 	{
 		header.MessageListenEndpoint.StartOffset = offset
-		ListenEndpoint := m.Address
-		s := []rune(ListenEndpoint)
-		s = append(s, 0)
-		ss := utf16.Encode(s)
 
-		size := uint32(len(ss) * sizeofUint16)
-
-		if err := binary.Write(&buf, binary.LittleEndian, ss); err != nil {
+		size, err := marshalEndpoint(&buf, &transportListenEndpoint{
+			Address:     m.Address,
+			ResolveType: m.resolveType(m.Address),
+			Port:        m.Port,
+		})
+		if err != nil {
 			return nil, err
 		}
 
-		if err := binary.Write(&buf, binary.LittleEndian, uint16(syscall.AF_INET)); err != nil {
+		header.MessageListenEndpoint.Size = size
+		offset += size
+	}
+
+	if leaseListenEndpoint != "" {
+		ep, err := parseListenEndpoint(leaseListenEndpoint)
+		if err != nil {
 			return nil, err
 		}
 
-		if err := binary.Write(&buf, binary.LittleEndian, m.Port); err != nil {
+		ep.ResolveType = m.resolveType(ep.Address)
+		header.LeaseListenEndpoint.StartOffset = offset
+
+		size, err := marshalEndpoint(&buf, &ep)
+		if err != nil {
 			return nil, err
 		}
 
-		header.MessageListenEndpoint.Size = size + sizeofAddressFamily + sizeofUShort
+		header.LeaseListenEndpoint.Size = size
 	}
 
 	return buf.Bytes(), nil
 }
 
 func (m *marshalContext) marshal(message *Message) ([]byte, error) {
+	if message.LeaseAgentInstance == 0 && m.LeaseAgentInstance != 0 {
+		withInstance := *message
+		withInstance.LeaseAgentInstance = m.LeaseAgentInstance
+		message = &withInstance
+	}
 
 	header := &leaseMessageHeader{}
-	header.MajorVersion = 2
-	header.MinorVersion = 1
-	header.MessageHeaderSize = uint32(binary.Size(header))
+	header.MajorVersion = leaseMessageMajorVersion
+	header.MinorVersion = leaseMessageMinorVersion
+	header.MessageHeaderSize = sizeofLeaseMessageHeader
+	if message.LeaseAgentInstance != 0 {
+		header.MessageHeaderSize += sizeofLeaseMessageExt
+	}
 	header.MessageType = message.Type
 	header.Duration = int32(message.Duration.Milliseconds())
 	header.Expiration = message.Expiration.Milliseconds()
@@ -284,9 +536,12 @@ func (m *marshalContext) marshal(message *Message) ([]byte, error) {
 	header.LeaseInstance = message.LeaseInstance
 	header.RemoteLeaseAgentInstance = message.RemoteLeaseAgentInstance
 
-	header.MessageIdentifier = uniqId()
+	header.MessageIdentifier = message.Identifier
+	if header.MessageIdentifier == 0 {
+		header.MessageIdentifier = uniqId()
+	}
 
-	body, err := m.marshalLeaseBody(header, &message.messageBody)
+	body, err := m.marshalLeaseBody(header, &message.messageBody, message.LeaseListenEndpoint)
 	if err != nil {
 		return nil, err
 	}
@@ -298,6 +553,12 @@ func (m *marshalContext) marshal(message *Message) ([]byte, error) {
 		return nil, err
 	}
 
+	if message.LeaseAgentInstance != 0 {
+		if err := binary.Write(&buf, binary.LittleEndian, &leaseMessageExt{MsgLeaseAgentInstance: uint64(message.LeaseAgentInstance)}); err != nil {
+			return nil, err
+		}
+	}
+
 	if err := binary.Write(&buf, binary.LittleEndian, body); err != nil {
 		return nil, err
 	}
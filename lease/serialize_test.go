@@ -0,0 +1,447 @@
+package lease
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMarshalBodyLists(t *testing.T) {
+	m := marshalContext{AppId: "local", Address: "10.0.0.1", Port: 1025}
+
+	msg := &Message{
+		Type:                 LeaseMessageTypeLeaseResponse,
+		LeaseInstance:        1,
+		Duration:             30 * time.Second,
+		LeaseSuspendDuration: 2 * time.Second,
+	}
+	msg.SubjectEstablishPendingList = []RelationshipIdentifier{{Remote: "a"}, {Remote: "b"}}
+	msg.SubjectPendingAcceptedList = []RelationshipIdentifier{{Local: "x", Remote: "y"}}
+	msg.SubjectTerminateAcceptedList = []RelationshipIdentifier{{Remote: "中文"}}
+
+	data, err := m.marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := unmarshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, msg.Type, decoded.Type)
+	assert.Equal(t, msg.Duration, decoded.Duration)
+	assert.Equal(t, msg.LeaseSuspendDuration, decoded.LeaseSuspendDuration)
+	assert.Equal(t, "10.0.0.1:1025", decoded.MessageListenEndpoint)
+	assert.Equal(t, []RelationshipIdentifier{{"local", "a"}, {"local", "b"}}, decoded.SubjectEstablishPendingList)
+	assert.Equal(t, []RelationshipIdentifier{{"x", "y"}}, decoded.SubjectPendingAcceptedList)
+	assert.Equal(t, []RelationshipIdentifier{{"local", "中文"}}, decoded.SubjectTerminateAcceptedList)
+	assert.Empty(t, decoded.SubjectFailedPendingList)
+	assert.Empty(t, decoded.MonitorFailedAcceptedList)
+
+	_, err = unmarshal(data[:len(data)-8])
+	assert.Error(t, err)
+}
+
+func TestMarshalLeaseListenEndpoint(t *testing.T) {
+	m := marshalContext{Address: "10.0.0.1", Port: 1025}
+
+	for _, ep := range []string{"", "10.0.0.2:2048"} {
+		data, err := m.marshal(&Message{
+			Type:                LeaseMessageTypeForwardRequest,
+			LeaseListenEndpoint: ep,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		decoded, err := unmarshal(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assert.Equal(t, "10.0.0.1:1025", decoded.MessageListenEndpoint)
+		assert.Equal(t, ep, decoded.LeaseListenEndpoint)
+	}
+}
+
+func TestListenEndpointEncoding(t *testing.T) {
+	// laid out as the native TRANSPORT_LISTEN_ENDPOINT: utf16 address with terminator, resolve type, port
+	for _, c := range []struct {
+		endpoint string
+		ep       transportListenEndpoint
+		wire     []byte
+	}{
+		{
+			"10.0.0.1:1025",
+			transportListenEndpoint{"10.0.0.1", addressFamilyInet, 1025},
+			[]byte{
+				'1', 0, '0', 0, '.', 0, '0', 0, '.', 0, '0', 0, '.', 0, '1', 0, 0, 0,
+				0x02, 0x00,
+				0x01, 0x04,
+			},
+		},
+		{
+			"[::1]:4660",
+			transportListenEndpoint{"::1", addressFamilyInet6, 4660},
+			[]byte{
+				':', 0, ':', 0, '1', 0, 0, 0,
+				0x17, 0x00,
+				0x34, 0x12,
+			},
+		},
+		{
+			"[fe80::1:2]:80",
+			transportListenEndpoint{"fe80::1:2", addressFamilyInet6, 80},
+			[]byte{
+				'f', 0, 'e', 0, '8', 0, '0', 0, ':', 0, ':', 0, '1', 0, ':', 0, '2', 0, 0, 0,
+				0x17, 0x00,
+				0x50, 0x00,
+			},
+		},
+		{
+			"node1.cluster:80",
+			transportListenEndpoint{"node1.cluster", addressFamilyUnspec, 80},
+			[]byte{
+				'n', 0, 'o', 0, 'd', 0, 'e', 0, '1', 0, '.', 0, 'c', 0, 'l', 0, 'u', 0, 's', 0, 't', 0, 'e', 0, 'r', 0, 0, 0,
+				0x00, 0x00,
+				0x50, 0x00,
+			},
+		},
+	} {
+		t.Run(c.endpoint, func(t *testing.T) {
+			ep, err := parseListenEndpoint(c.endpoint)
+			assert.NoError(t, err)
+			assert.Equal(t, c.ep, ep)
+			assert.Equal(t, c.endpoint, ep.String())
+
+			var buf bytes.Buffer
+			size, err := marshalEndpoint(&buf, &ep)
+			assert.NoError(t, err)
+			assert.Equal(t, uint32(len(c.wire)), size)
+			assert.Equal(t, c.wire, buf.Bytes())
+
+			decoded, err := unmarshalEndpoint(c.wire)
+			assert.NoError(t, err)
+			assert.Equal(t, c.ep, decoded)
+
+			host, _, _ := net.SplitHostPort(c.endpoint)
+			m := marshalContext{Address: host, Port: ep.Port}
+			data, err := m.marshal(&Message{Type: LeaseMessageTypePingRequest, LeaseListenEndpoint: c.endpoint})
+			assert.NoError(t, err)
+
+			msg, err := unmarshal(data)
+			assert.NoError(t, err)
+			assert.Equal(t, c.endpoint, msg.MessageListenEndpoint)
+			assert.Equal(t, c.endpoint, msg.LeaseListenEndpoint)
+		})
+	}
+}
+
+func TestUnmarshalEndpointFamily(t *testing.T) {
+	// the family is kept as sent, linux nodes send AF_INET6 as 10
+	for _, c := range []struct {
+		wire     []byte
+		endpoint string
+		family   uint16
+	}{
+		{[]byte{':', 0, ':', 0, '1', 0, 0, 0, 0x0a, 0x00, 0x50, 0x00}, "[::1]:80", 10},
+		{[]byte{'1', 0, '.', 0, '2', 0, '.', 0, '3', 0, '.', 0, '4', 0, 0, 0, 0x02, 0x00, 0x50, 0x00}, "1.2.3.4:80", addressFamilyInet},
+		{[]byte{'h', 0, 0, 0, 0xff, 0xff, 0x50, 0x00}, "h:80", 0xffff},
+	} {
+		ep, err := unmarshalEndpoint(c.wire)
+		assert.NoError(t, err)
+		assert.Equal(t, c.family, ep.ResolveType)
+		assert.Equal(t, c.endpoint, ep.String())
+	}
+}
+
+func TestMarshalAddressFamilyInet6(t *testing.T) {
+	// linux peers expect their AF_INET6
+	m := marshalContext{Address: "::1", Port: 80, AddressFamilyInet6: 10}
+	data, err := m.marshal(&Message{Type: LeaseMessageTypePingRequest, LeaseListenEndpoint: "[::1]:80"})
+	assert.NoError(t, err)
+
+	linux := []byte{':', 0, ':', 0, '1', 0, 0, 0, 0x0a, 0x00, 0x50, 0x00}
+	assert.Equal(t, 2, bytes.Count(data, linux))
+
+	msg, err := unmarshal(data)
+	assert.NoError(t, err)
+	assert.Equal(t, "[::1]:80", msg.MessageListenEndpoint)
+	assert.Equal(t, "[::1]:80", msg.LeaseListenEndpoint)
+
+	// ipv4 and hostnames are not affected
+	m.Address = "10.0.0.1"
+	data, err = m.marshal(&Message{Type: LeaseMessageTypePingRequest})
+	assert.NoError(t, err)
+	assert.True(t, bytes.Contains(data, []byte{'1', 0, 0, 0, 0x02, 0x00, 0x50, 0x00}))
+}
+
+func TestMarshalRoundTrip(t *testing.T) {
+	full := &Message{
+		Identifier:               7,
+		Type:                     LeaseMessageTypeRelayResponse,
+		LeaseInstance:            11,
+		RemoteLeaseAgentInstance: 12,
+		Duration:                 30 * time.Second,
+		Expiration:               45 * time.Second,
+		LeaseSuspendDuration:     2 * time.Second,
+		ArbitrationDuration:      time.Minute,
+		IsTwoWayTermination:      true,
+		LeaseListenEndpoint:      "[2001:db8::1]:3000",
+		LeaseAgentInstance:       13,
+	}
+
+	for i, d := range bodyLists(&leaseMessageHeader{}, &full.messageBody) {
+		for j := 0; j <= i%3; j++ {
+			*d.list = append(*d.list, RelationshipIdentifier{
+				Local:  fmt.Sprintf("local%v", i),
+				Remote: fmt.Sprintf("remote%v-%v", i, j),
+			})
+		}
+	}
+
+	for name, c := range map[string]struct {
+		m   marshalContext
+		msg *Message
+	}{
+		"empty":     {marshalContext{Address: "10.0.0.1", Port: 1}, &Message{Identifier: 1}},
+		"ping":      {marshalContext{Address: "10.0.0.1", Port: 1025}, &Message{Identifier: 2, Type: LeaseMessageTypePingRequest, Expiration: time.Second}},
+		"full ipv6": {marshalContext{Address: "fe80::1", Port: 65535}, full},
+		"hostname":  {marshalContext{Address: "node.cluster", Port: 80}, full},
+	} {
+		t.Run(name, func(t *testing.T) {
+			data, err := c.m.marshal(c.msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			decoded, err := unmarshal(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expected := *c.msg
+			expected.MessageListenEndpoint = net.JoinHostPort(c.m.Address, strconv.Itoa(int(c.m.Port)))
+			assert.Equal(t, &expected, decoded)
+
+			// re-encode from decoded values only
+			ep, err := parseListenEndpoint(decoded.MessageListenEndpoint)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			again, err := (&marshalContext{Address: ep.Address, Port: ep.Port}).marshal(decoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			assert.Equal(t, data, again)
+		})
+	}
+}
+
+func TestUnmarshalVersions(t *testing.T) {
+	m := marshalContext{AppId: "app", Address: "10.0.0.1", Port: 1025}
+	msg := &Message{Type: LeaseMessageTypeLeaseRequest, LeaseAgentInstance: 5}
+	msg.SubjectEstablishPendingList = []RelationshipIdentifier{{Remote: "app"}}
+
+	data, err := m.marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, uint8(leaseMessageMajorVersion), data[0])
+	assert.Equal(t, uint8(leaseMessageMinorVersion), data[1])
+
+	clone := func() []byte {
+		return append([]byte(nil), data...)
+	}
+
+	t.Run("newer minor", func(t *testing.T) {
+		d := clone()
+		d[1]++
+		decoded, err := unmarshal(d)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(5), decoded.LeaseAgentInstance)
+	})
+
+	t.Run("other major", func(t *testing.T) {
+		d := clone()
+		d[0]++
+		_, err := unmarshal(d)
+		assert.Error(t, err)
+	})
+
+	t.Run("without extension", func(t *testing.T) {
+		msg.LeaseAgentInstance = 0
+		d, err := m.marshal(msg)
+		assert.NoError(t, err)
+		assert.Equal(t, len(data)-int(sizeofLeaseMessageExt), len(d))
+
+		decoded, err := unmarshal(d)
+		assert.NoError(t, err)
+		assert.Zero(t, decoded.LeaseAgentInstance)
+		assert.Equal(t, msg.SubjectEstablishPendingList[0].Remote, decoded.SubjectEstablishPendingList[0].Remote)
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		for _, n := range []int{0, int(sizeofLeaseMessageHeader) - 1, int(sizeofLeaseMessageHeader), len(data) - 1} {
+			_, err := unmarshal(data[:n])
+			assert.Error(t, err, n)
+		}
+	})
+
+	t.Run("trailing data", func(t *testing.T) {
+		d := append(clone(), 0xde, 0xad, 0xbe, 0xef)
+		binary.LittleEndian.PutUint32(d[8:], uint32(len(d)))
+
+		decoded, err := unmarshal(d)
+		assert.NoError(t, err)
+		assert.Equal(t, "10.0.0.1:1025", decoded.MessageListenEndpoint)
+		assert.Empty(t, decoded.LeaseListenEndpoint)
+	})
+
+	t.Run("bad lease listen endpoint ignored", func(t *testing.T) {
+		msg := *msg
+		msg.LeaseListenEndpoint = "10.0.0.2:2048"
+		data, err := m.marshal(&msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		header := leaseMessageHeader{}
+		offset := uint32(binary.Size(header) - binary.Size(header.LeaseListenEndpoint))
+
+		for name, desc := range map[string]listDesc{
+			"out of range": {StartOffset: uint32(len(data)), Size: 12},
+			"bad size":     {StartOffset: uint32(len(data)) - 3, Size: 3},
+		} {
+			d := append([]byte(nil), data...)
+			binary.LittleEndian.PutUint32(d[offset+4:], desc.StartOffset)
+			binary.LittleEndian.PutUint32(d[offset+8:], desc.Size)
+
+			decoded, err := unmarshal(d)
+			assert.NoError(t, err, name)
+			assert.Empty(t, decoded.LeaseListenEndpoint, name)
+			assert.Equal(t, "10.0.0.1:1025", decoded.MessageListenEndpoint, name)
+		}
+	})
+
+	t.Run("list inside header", func(t *testing.T) {
+		d := clone()
+		binary.LittleEndian.PutUint32(d[80:], sizeofLeaseMessageHeader)
+		_, err := unmarshal(d)
+		assert.Error(t, err)
+	})
+
+	t.Run("list out of range", func(t *testing.T) {
+		d := clone()
+		// start offset of SubjectEstablishPendingList
+		binary.LittleEndian.PutUint32(d[80:], uint32(len(d)))
+		_, err := unmarshal(d)
+		assert.Error(t, err)
+	})
+
+	t.Run("size beyond data", func(t *testing.T) {
+		d := clone()
+		// size prefix of SubjectEstablishPendingList
+		start := binary.LittleEndian.Uint32(d[80:])
+		binary.LittleEndian.PutUint32(d[start:], math.MaxUint32)
+		_, err := unmarshal(d)
+		assert.Error(t, err)
+
+		_, err = unmarshalString(bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xff, 'a', 0}))
+		assert.Error(t, err)
+	})
+}
+
+func TestUnmarshalLinuxPingRequest(t *testing.T) {
+	// hand assembled field by field as the native LEASE_MESSAGE_HEADER of a linux node, not a capture
+	data, err := hex.DecodeString(strings.Join([]string{
+		"02", "01", "0000", // version 2.1
+		"d0000000", // MessageHeaderSize 208
+		"e4000000", // MessageSize 228
+		"00000000",
+		"e6d5c4b3a2f1d801",     // MessageIdentifier
+		"02000000", "00000000", // PingRequest
+		"00d5c4b3a2f1d801",     // LeaseInstance
+		"0000000000000000",     // RemoteLeaseAgentInstance
+		"00000000", "00000000", // Duration
+		"3075000000000000",     // Expiration 30s
+		"00000000", "00000000", // LeaseSuspendDuration, ArbitrationDuration
+		"00", "000000", // IsTwoWayTermination
+		strings.Repeat("00000000d000000000000000", 9),      // empty relationship lists
+		"00000000d000000014000000",                         // MessageListenEndpoint
+		"000000000000000000000000",                         // LeaseListenEndpoint
+		"66006500380030003a003a0031000000", "0a00", "0204", // fe80::1, linux AF_INET6, 1026
+	}, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := unmarshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, LeaseMessageTypePingRequest, m.Type)
+	assert.Equal(t, int64(0x01d8f1a2b3c4d5e6), m.Identifier)
+	assert.Equal(t, int64(0x01d8f1a2b3c4d500), m.LeaseInstance)
+	assert.Equal(t, 30*time.Second, m.Expiration)
+	assert.Equal(t, "[fe80::1]:1026", m.MessageListenEndpoint)
+	assert.Empty(t, m.LeaseListenEndpoint)
+	assert.Zero(t, m.LeaseAgentInstance)
+}
+
+func TestUnmarshalLeaseRequestWithExtension(t *testing.T) {
+	// hand assembled field by field as the native LEASE_MESSAGE_HEADER followed by LEASE_MESSAGE_EXT, not a capture
+	data, err := hex.DecodeString(strings.Join([]string{
+		"02", "01", "0000", // version 2.1
+		"d8000000", // MessageHeaderSize 216, header and extension
+		"0a010000", // MessageSize 266
+		"00000000",
+		"0100000000000000",     // MessageIdentifier
+		"00000000", "00000000", // LeaseRequest
+		"0200000000000000",     // LeaseInstance
+		"0000000000000000",     // RemoteLeaseAgentInstance
+		"30750000", "00000000", // Duration 30s
+		"0000000000000000",     // Expiration
+		"d0070000", "30750000", // LeaseSuspendDuration 2s, ArbitrationDuration 30s
+		"00", "000000", // IsTwoWayTermination
+		"01000000d80000001c000000",                                             // SubjectEstablishPendingList
+		strings.Repeat("00000000f400000000000000", 8),                          // empty lists
+		"00000000f400000016000000",                                             // MessageListenEndpoint
+		"000000000000000000000000",                                             // LeaseListenEndpoint
+		"0300000000000000",                                                     // MsgLeaseAgentInstance
+		"18000000", "01000000", "06000000610070007000", "06000000610070007000", // [{app app}]
+		"310030002e0030002e0030002e0031000000", "0200", "0104", // 10.0.0.1, AF_INET, 1025
+	}, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := unmarshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, LeaseMessageTypeLeaseRequest, m.Type)
+	assert.Equal(t, int64(2), m.LeaseInstance)
+	assert.Equal(t, int64(3), m.LeaseAgentInstance)
+	assert.Equal(t, 30*time.Second, m.Duration)
+	assert.Equal(t, 2*time.Second, m.LeaseSuspendDuration)
+	assert.Equal(t, 30*time.Second, m.ArbitrationDuration)
+	assert.Equal(t, []RelationshipIdentifier{{"app", "app"}}, m.SubjectEstablishPendingList)
+	assert.Empty(t, m.SubjectPendingAcceptedList)
+	assert.Equal(t, "10.0.0.1:1025", m.MessageListenEndpoint)
+}
@@ -0,0 +1,67 @@
+package lease
+
+import (
+	"context"
+	"fmt"
+)
+
+// Terminate ends the lease gracefully, the remote agent records a clean departure and drops its lease with us as well.
+// The session is closed once the remote accepted the termination.
+func (s *leaseSession) Terminate(ctx context.Context) error {
+	m, err := s.request(ctx, s.createTerminateRequest(), func(m *Message) bool {
+		return len(m.SubjectTerminateAcceptedList) > 0
+	})
+	if err != nil {
+		return err
+	}
+
+	if !m.IsTwoWayTermination {
+		return fmt.Errorf("remote %v did not accept two way termination", s.addr)
+	}
+
+	s.parent.logger.Info("lease terminated", "endpoint", s.addr)
+
+	return s.Close()
+}
+
+func (s *leaseSession) createTerminateRequest() *Message {
+	message := Message{}
+	message.Type = LeaseMessageTypeLeaseRequest
+	message.LeaseInstance = s.localInstance
+	message.RemoteLeaseAgentInstance = s.RemoteInstance()
+	message.IsTwoWayTermination = true
+	message.SubjectTerminatePendingList = []RelationshipIdentifier{s.relationship()}
+	return &message
+}
+
+// acceptTermination fills the termination part of a lease response,
+// a two way termination also closes our own session to the requester without failing it
+func (a *Agent) acceptTermination(m *Message, reply *Message) {
+	if len(m.SubjectTerminatePendingList) == 0 {
+		return
+	}
+
+	for _, r := range m.SubjectTerminatePendingList {
+		reply.SubjectTerminateAcceptedList = append(reply.SubjectTerminateAcceptedList, RelationshipIdentifier{Local: r.Remote, Remote: r.Local})
+	}
+
+	reply.IsTwoWayTermination = m.IsTwoWayTermination
+	reply.Duration = 0
+	a.remotes.Delete(m.MessageListenEndpoint)
+
+	if !m.IsTwoWayTermination {
+		return
+	}
+
+	endpoint := m.MessageListenEndpoint
+	a.logger.Info("lease terminated by remote", "endpoint", endpoint)
+
+	// the reply goes through a peer connection once the session is gone
+	if s, ok := a.sessions.Load(endpoint); ok {
+		s.(Session).Close()
+	}
+
+	if cb := a.config.TerminatedCallback; cb != nil {
+		cb(a, endpoint)
+	}
+}
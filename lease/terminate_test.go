@@ -0,0 +1,61 @@
+package lease
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessionTerminate(t *testing.T) {
+	var config AgentConfig
+	config.SetDefault()
+	config.LeaseDuration = 300 * time.Millisecond
+	config.LeaseSuspendTimeout = 100 * time.Millisecond
+
+	states := make(chan LeaseAgentState, 4)
+	config.StateCallback = func(s Session, state LeaseAgentState) {
+		states <- state
+	}
+
+	terminated := make(chan string, 1)
+	config.TerminatedCallback = func(a *Agent, endpoint string) {
+		terminated <- endpoint
+	}
+
+	a := newTestAgentWithConfig(t, config)
+	b := newTestAgentWithConfig(t, config)
+
+	sa, err := a.Establish(b.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sb, err := b.Establish(a.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	assert.NoError(t, sa.Terminate(ctx))
+	assert.Equal(t, a.Addr().String(), <-terminated)
+
+	_, ok := a.sessions.Load(b.Addr().String())
+	assert.False(t, ok)
+	_, ok = b.sessions.Load(a.Addr().String())
+	assert.False(t, ok)
+	assert.Empty(t, b.RemoteLeases())
+
+	// neither side fails after the lease would have expired
+	time.Sleep(2 * config.LeaseDuration)
+	assert.Empty(t, states)
+	assert.Equal(t, LeaseAgentStateOpen, sa.State())
+	assert.Equal(t, LeaseAgentStateOpen, sb.State())
+	assert.Equal(t, LeaseAgentStateOpen, a.State())
+	assert.Equal(t, LeaseAgentStateOpen, b.State())
+
+	assert.Error(t, sa.Ping(ctx))
+}
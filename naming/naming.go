@@ -2,8 +2,9 @@ package naming
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -13,33 +14,42 @@ import (
 	"github.com/tg123/phabrik/transport"
 )
 
-type ProtocolVersion struct {
-	Major int64
-	Minor int64
+func init() {
+	transport.RegisterHeaderActivator(transport.MessageHeaderIdTypeGeneration, func() interface{} {
+		return &GenerationHeader{}
+	})
 }
 
-type ActivityId struct {
-	Id    serialization.GUID
-	Index uint64
-}
+type ProtocolVersion = transport.ClientProtocolVersionHeader
+
+type ActivityId = transport.FabricActivityId
 
-func (a ActivityId) IsEmpty() bool {
-	return a.Id.IsEmpty() && a.Index == 0
+// GenerationHeader lives here instead of transport as GenerationNumber is owned by a federation.NodeID
+type GenerationHeader struct {
+	Generation     GenerationNumber
+	IsForFMReplica bool
 }
 
-func (a ActivityId) String() string {
-	return fmt.Sprintf("%v:%v", a.Id.String(), a.Index)
+func GetGenerationHeader(h *transport.MessageHeaders) (GenerationHeader, bool) {
+	v, ok := h.GetFirstCustomHeader(transport.MessageHeaderIdTypeGeneration)
+	if !ok {
+		return GenerationHeader{}, false
+	}
+
+	gh, ok := v.(*GenerationHeader)
+	if !ok {
+		return GenerationHeader{}, false
+	}
+
+	return *gh, true
 }
 
-// func init() {
-// 	transport.RegisterHeaderActivator(transport.MessageHeaderIdTypeFabricActivity, func() interface{} {
-// 		return &ActivityId{}
-// 	})
-// }
+func SetGenerationHeader(h *transport.MessageHeaders, generation GenerationHeader) {
+	h.ReplaceCustomHeader(transport.MessageHeaderIdTypeGeneration, &generation)
+}
 
 func NewNamingMessage(action string) (*transport.Message, error) {
-	activityId, err := serialization.NewGuidV4()
-
+	activityId, err := transport.NewFabricActivityId()
 	if err != nil {
 		return nil, err
 	}
@@ -49,24 +59,12 @@ func NewNamingMessage(action string) (*transport.Message, error) {
 	msg.Headers.Action = action
 	msg.Headers.ExpectsReply = true
 
-	msg.Headers.SetCustomHeader(transport.MessageHeaderIdTypeFabricActivity, &struct {
-		Activity ActivityId
-	}{
-		Activity: ActivityId{
-			Id: activityId,
-		},
-	})
-
-	msg.Headers.SetCustomHeader(transport.MessageHeaderIdTypeClientProtocolVersion, &ProtocolVersion{
+	msg.Headers.SetFabricActivity(activityId)
+	msg.Headers.SetClientProtocolVersion(ProtocolVersion{
 		Major: 1,
 		Minor: 2,
 	})
-
-	msg.Headers.SetCustomHeader(transport.MessageHeaderIdTypeTimeout, &struct {
-		Timeout time.Duration
-	}{
-		Timeout: 20 * time.Millisecond,
-	})
+	msg.Headers.SetTimeout(2 * time.Second)
 
 	return msg, nil
 }
@@ -74,12 +72,49 @@ func NewNamingMessage(action string) (*transport.Message, error) {
 type NamingClient struct {
 	OnServiceNotification func(notification *ServiceNotification)
 
-	transport    *transport.Client
+	transport    Transport
 	nextFilterId uint64
 	clientId     string
+	logger       common.Logger
+
+	notificationLock sync.Mutex
+	notificationConn transport.Conn
+	filters          []*ServiceNotificationFilter
+}
+
+// Transport is what NamingClient sends requests over, either a *transport.Client or a *transport.ClientPool
+type Transport interface {
+	transport.Conn
+	SetMessageCallback(cb transport.MessageCallback)
+}
+
+var (
+	_ Transport = (*transport.Client)(nil)
+	_ Transport = (*transport.ClientPool)(nil)
+)
+
+// stickyTransport pins notification traffic to one connection, implemented by *transport.ClientPool
+type stickyTransport interface {
+	Sticky() (*transport.Client, error)
 }
 
-func NewNamingClient(transport *transport.Client) (*NamingClient, error) {
+var _ stickyTransport = (*transport.ClientPool)(nil)
+
+const (
+	notificationReconnectTimeout = 10 * time.Second
+	notificationReconnectBackoff = time.Second
+)
+
+type NamingClientConfig struct {
+	// Logger only warnings and errors are written to log.Default() if nil
+	Logger common.Logger
+}
+
+func NewNamingClient(transport Transport) (*NamingClient, error) {
+	return NewNamingClientWithConfig(transport, NamingClientConfig{})
+}
+
+func NewNamingClientWithConfig(transport Transport, config NamingClientConfig) (*NamingClient, error) {
 	guid, err := serialization.NewGuidV4()
 	if err != nil {
 		return nil, err
@@ -89,6 +124,7 @@ func NewNamingClient(transport *transport.Client) (*NamingClient, error) {
 		transport:    transport,
 		nextFilterId: 0,
 		clientId:     "phabrik-" + guid.String(),
+		logger:       common.LoggerOrDefault(config.Logger),
 	}
 
 	// TODO chain design
@@ -150,12 +186,13 @@ func (n *NamingClient) onMessage(conn transport.Conn, bam *transport.ByteArrayMe
 
 		err := serialization.Unmarshal(bam.Body, &b)
 		if err != nil {
-			log.Printf("ServiceNotificationRequest unmarshal err %v", err)
+			n.logger.Warn("ServiceNotificationRequest unmarshal failed", n.messageLogArgs(bam, err)...)
 		}
 
 		reply, err := NewNamingMessage("ServiceNotificationReply")
 		if err != nil {
-			log.Printf("ServiceNotificationRequest NewNamingMessage err %v", err)
+			n.logger.Error("ServiceNotificationReply create failed", n.messageLogArgs(bam, err)...)
+			return
 		}
 
 		reply.Headers.RelatesTo = bam.Headers.Id
@@ -171,12 +208,30 @@ func (n *NamingClient) onMessage(conn transport.Conn, bam *transport.ByteArrayMe
 			go n.OnServiceNotification(b.Notification)
 		}
 	default:
-		log.Printf("unsupported action %v", bam.Headers.Action)
+		n.logger.Debug("unsupported action", append(n.messageLogArgs(bam, nil), "action", bam.Headers.Action)...)
+	}
+}
+
+func (n *NamingClient) messageLogArgs(bam *transport.ByteArrayMessage, err error) []interface{} {
+	args := []interface{}{common.LogKeyMessageId, bam.Headers.Id}
+
+	if a, ok := bam.Headers.FabricActivity(); ok {
+		args = append(args, common.LogKeyActivityId, a)
 	}
+
+	if err != nil {
+		args = append(args, common.LogKeyError, err)
+	}
+
+	return args
 }
 
 func (n *NamingClient) requestReply(ctx context.Context, msg *transport.Message) (*transport.ByteArrayMessage, error) {
-	reply, err := n.transport.RequestReply(context.TODO(), msg)
+	return n.requestReplyOver(ctx, n.transport, msg)
+}
+
+func (n *NamingClient) requestReplyOver(ctx context.Context, conn transport.Conn, msg *transport.Message) (*transport.ByteArrayMessage, error) {
+	reply, err := conn.RequestReply(ctx, msg)
 	if err != nil {
 		return nil, err
 	}
@@ -281,53 +336,120 @@ func (n *NamingClient) RegisterFilter(ctx context.Context, name common.Uri, matc
 		flags |= 2
 	}
 
-	{
-		msg, err := NewNamingMessage("NotificationClientConnectionRequest")
-		if err != nil {
-			return 0, err
-		}
+	filter := &ServiceNotificationFilter{
+		FilterId: filterId,
+		Name:     name,
+		Flags:    ServiceNotificationFilterFlags{flags},
+	}
 
-		msg.Body = &NotificationClientConnectionRequestBody{
-			ClientId:       n.clientId,
-			ClientVersions: &VersionRangeCollection{},
-		}
+	n.notificationLock.Lock()
+	defer n.notificationLock.Unlock()
 
-		_, err = n.requestReply(ctx, msg)
+	conn, err := n.connectNotification(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	msg, err := NewNamingMessage("RegisterServiceNotificationFilterRequest")
+	if err != nil {
+		return 0, err
+	}
+
+	msg.Headers.SetClientIdentity(transport.ClientIdentityHeader{
+		TargetName:   "",
+		FriendlyName: n.clientId,
+	})
+
+	msg.Body = &RegisterServiceNotificationFilterRequestBody{
+		ClientId: n.clientId,
+		Filter:   filter,
+	}
+
+	_, err = n.requestReplyOver(ctx, conn, msg)
+	if err != nil {
+		return 0, err
+	}
+
+	n.filters = append(n.filters, filter)
+
+	return filterId, nil
+}
+
+// connectNotification returns the connection the gateway keeps filters on,
+// filters registered so far are sent along when it moves to a new connection.
+// The caller holds notificationLock.
+func (n *NamingClient) connectNotification(ctx context.Context) (transport.Conn, error) {
+	var conn transport.Conn = n.transport
+	if s, ok := n.transport.(stickyTransport); ok {
+		c, err := s.Sticky()
 		if err != nil {
-			return 0, err
+			return nil, err
 		}
+
+		conn = c
 	}
 
-	{
-		msg, err := NewNamingMessage("RegisterServiceNotificationFilterRequest")
-		if err != nil {
-			return 0, err
+	if conn == n.notificationConn {
+		return conn, nil
+	}
+
+	msg, err := NewNamingMessage("NotificationClientConnectionRequest")
+	if err != nil {
+		return nil, err
+	}
+
+	msg.Body = &NotificationClientConnectionRequestBody{
+		ClientId:       n.clientId,
+		ClientVersions: &VersionRangeCollection{},
+		Filters:        n.filters,
+	}
+
+	if _, err := n.requestReplyOver(ctx, conn, msg); err != nil {
+		return nil, err
+	}
+
+	n.notificationConn = conn
+
+	if d, ok := conn.(interface{ Done() <-chan struct{} }); ok {
+		go n.reconnectNotification(conn, d.Done())
+	}
+
+	return conn, nil
+}
+
+// reconnectNotification moves filters to another connection of the transport once conn is closed
+func (n *NamingClient) reconnectNotification(conn transport.Conn, done <-chan struct{}) {
+	<-done
+
+	s, ok := n.transport.(stickyTransport)
+	if !ok {
+		return
+	}
+
+	for {
+		// transport closed
+		if _, err := s.Sticky(); errors.Is(err, transport.ErrOperationCancelled) {
+			return
 		}
 
-		msg.Headers.SetCustomHeader(transport.MessageHeaderIdTypeClientIdentity, &struct {
-			TargetName   string
-			FriendlyName string
-		}{
-			TargetName:   "",
-			FriendlyName: n.clientId,
-		})
-
-		msg.Body = &RegisterServiceNotificationFilterRequestBody{
-			ClientId: n.clientId,
-			Filter: &ServiceNotificationFilter{
-				FilterId: filterId,
-				Name:     name,
-				Flags:    ServiceNotificationFilterFlags{flags},
-			},
+		n.notificationLock.Lock()
+		if n.notificationConn != conn {
+			n.notificationLock.Unlock()
+			return
 		}
 
-		_, err = n.requestReply(ctx, msg)
-		if err != nil {
-			return 0, err
+		ctx, cancel := context.WithTimeout(context.Background(), notificationReconnectTimeout)
+		_, err := n.connectNotification(ctx)
+		cancel()
+		n.notificationLock.Unlock()
+
+		if err == nil {
+			return
 		}
-	}
 
-	return filterId, nil
+		n.logger.Warn("notification reconnect failed", common.LogKeyError, err)
+		time.Sleep(notificationReconnectBackoff)
+	}
 }
 
 type ApplicationQueryResult struct {
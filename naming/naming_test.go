@@ -0,0 +1,96 @@
+package naming
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tg123/phabrik/common"
+	"github.com/tg123/phabrik/serialization"
+	"github.com/tg123/phabrik/transport"
+)
+
+func TestRegisterFilterReconnect(t *testing.T) {
+	var lock sync.Mutex
+	var conns []transport.Conn
+	var connected [][]*ServiceNotificationFilter
+	registered := make(map[transport.Conn]int)
+
+	network := transport.NewMemoryNetwork()
+	server, err := transport.ListenMemory(network, "gateway:0", transport.ServerConfig{
+		MessageCallback: func(c transport.Conn, bam *transport.ByteArrayMessage) {
+			lock.Lock()
+			switch bam.Headers.Action {
+			case "NotificationClientConnectionRequest":
+				var b NotificationClientConnectionRequestBody
+				if err := serialization.Unmarshal(bam.Body, &b); err != nil {
+					t.Error(err)
+				}
+
+				conns = append(conns, c)
+				connected = append(connected, b.Filters)
+			case "RegisterServiceNotificationFilterRequest":
+				registered[c]++
+			}
+			lock.Unlock()
+
+			msg := &transport.Message{}
+			msg.Headers.RelatesTo = bam.Headers.Id
+			c.SendOneWay(msg)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	go server.Serve()
+
+	pool, err := transport.NewClientPool(transport.ClientPoolConfig{
+		Endpoints: []string{server.Addr().String()},
+		Size:      3,
+		Dial: func(addr string, config transport.ClientConfig) (*transport.Client, error) {
+			return transport.DialMemory(network, addr, config)
+		},
+		HealthCheckInterval: 20 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	client, err := NewNamingClient(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"/a", "/b", "/c"} {
+		name := common.Uri{Type: common.UriTypeAbsolute, Scheme: "fabric", Path: path}
+		_, err := client.RegisterFilter(context.Background(), name, true, false)
+		assert.NoError(t, err)
+	}
+
+	lock.Lock()
+	assert.Len(t, conns, 1)
+	assert.Empty(t, connected[0])
+	assert.Equal(t, 3, registered[conns[0]])
+	first := conns[0]
+	lock.Unlock()
+
+	first.Close()
+
+	assert.Eventually(t, func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(conns) == 2
+	}, time.Second, time.Millisecond)
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	assert.NotEqual(t, first, conns[1])
+	if assert.Len(t, connected[1], 3) {
+		assert.Equal(t, "/c", connected[1][2].Name.Path)
+	}
+}
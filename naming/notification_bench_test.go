@@ -0,0 +1,110 @@
+package naming
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/tg123/phabrik/serialization"
+	"github.com/tg123/phabrik/transport"
+)
+
+// newBenchServiceNotification builds a notification page as sent to clients watching a large application
+func newBenchServiceNotification(partitions int) *ServiceNotification {
+	n := &ServiceNotification{
+		Generation: GenerationNumber{Generation: 132953621845570000},
+		Versions: &VersionRangeCollection{
+			VersionRanges: []VersionRange{{StartVersion: 1, EndVersion: int64(partitions) + 1}},
+		},
+	}
+
+	for i := 0; i < partitions; i++ {
+		var replicas []string
+		for r := 0; r < 4; r++ {
+			replicas = append(replicas, fmt.Sprintf(
+				`{"Endpoints":{"":"net.tcp:\/\/10.0.%d.%d:20%03d\/%s\/%d-%d"}}`,
+				r, i%250, i%1000, serialization.MustNewGuidV4(), 132953621845570000+i, r))
+		}
+
+		n.Partitions = append(n.Partitions, &ServiceTableEntryNotification{
+			ServiceTable: &ServiceTableEntry{
+				ConsistencyUnitId: ConsistencyUnitId{GUID: serialization.MustNewGuidV4()},
+				ServiceName:       fmt.Sprintf("fabric:/contoso/orders/shard%04d", i),
+				ServiceReplicaSet: ServiceReplicaSet{
+					IsStateful:             true,
+					IsPrimaryLocationValid: true,
+					PrimaryLocation:        replicas[0],
+					ReplicaLocations:       replicas[1:],
+					LookupVersion:          int64(i),
+				},
+				IsFound: true,
+			},
+		})
+	}
+
+	return n
+}
+
+func BenchmarkServiceNotificationCompression(b *testing.B) {
+	for _, partitions := range []int{10, 100, 1000} {
+		body, err := serialization.Marshal(&struct {
+			Notification *ServiceNotification
+		}{newBenchServiceNotification(partitions)})
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		for _, compression := range []bool{false, true} {
+			b.Run(fmt.Sprintf("partitions=%d/compression=%v", partitions, compression), func(b *testing.B) {
+				network := transport.NewMemoryNetwork()
+				server, err := transport.ListenMemory(network, "bench:0", transport.ServerConfig{
+					Config: transport.Config{EnableCompression: compression},
+					MessageCallback: func(c transport.Conn, bam *transport.ByteArrayMessage) {
+						msg := &transport.Message{}
+						msg.Headers.RelatesTo = bam.Headers.Id
+						c.SendOneWay(msg)
+					},
+				})
+				if err != nil {
+					b.Fatal(err)
+				}
+				defer server.Close()
+				go server.Serve()
+
+				client, err := transport.DialMemory(network, server.Addr().String(), transport.ClientConfig{
+					Config: transport.Config{EnableCompression: compression},
+				})
+				if err != nil {
+					b.Fatal(err)
+				}
+				defer client.Close()
+				go client.Wait()
+
+				// negotiate before measuring
+				if _, err := client.RequestReply(context.Background(), &transport.Message{}); err != nil {
+					b.Fatal(err)
+				}
+
+				start := client.Stats().BytesSent
+
+				b.SetBytes(int64(len(body)))
+				b.ResetTimer()
+
+				for i := 0; i < b.N; i++ {
+					msg, err := NewNamingMessage("ServiceNotificationRequest")
+					if err != nil {
+						b.Fatal(err)
+					}
+
+					msg.Body = body
+					if _, err := client.RequestReply(context.Background(), msg); err != nil {
+						b.Fatal(err)
+					}
+				}
+
+				b.StopTimer()
+				b.ReportMetric(float64(client.Stats().BytesSent-start)/float64(b.N), "wire-B/op")
+			})
+		}
+	}
+}
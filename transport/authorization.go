@@ -0,0 +1,134 @@
+package transport
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	connectionAuthAction = "ConnectionAuth"
+
+	authorizeWaitTimeout = 10 * time.Second
+)
+
+type connectionAuthMessageBody struct {
+	Message string
+}
+
+// ConnectionAuthError is sent to the client in the ConnectionAuth message when a connection is rejected,
+// clients get it back from Wait
+type ConnectionAuthError struct {
+	Code    FabricErrorCode
+	Message string
+}
+
+func (e *ConnectionAuthError) Error() string {
+	return fmt.Sprintf("connection auth failure, error code [%v], msg [%v]", e.Code, e.Message)
+}
+
+// ConnectionAuthInfo is what a ConnectionAuthorizer knows about a new connection
+type ConnectionAuthInfo struct {
+	RemoteAddr       net.Addr
+	PeerCertificates []*x509.Certificate
+	// Claims is the token accepted by ClaimsValidator, empty if claims are not used
+	Claims       string
+	FirstMessage *ByteArrayMessage
+}
+
+// ConnectionAuthorizer decides the role of a client by its first message,
+// return a ConnectionAuthError to control the error code sent to the client, other errors are sent as access denied
+type ConnectionAuthorizer func(info *ConnectionAuthInfo) (RoleMask, error)
+
+// AuthorizedConn is implemented by connections accepted by a Server
+type AuthorizedConn interface {
+	Conn
+	Role() RoleMask
+	PeerCertificates() []*x509.Certificate
+}
+
+var _ AuthorizedConn = (*connection)(nil)
+
+func (c *connection) Role() RoleMask {
+	return c.role
+}
+
+func (c *connection) PeerCertificates() []*x509.Certificate {
+	return c.peerCertificates
+}
+
+func (c *connection) sendConnectionAuth(code FabricErrorCode, text string) error {
+	msg := c.msgfac.newMessage()
+	msg.Headers.Actor = MessageActorTypeTransportSendTarget
+	msg.Headers.Action = connectionAuthAction
+	msg.Headers.HighPriority = true
+	msg.Headers.ErrorCode = code
+	msg.Body = &connectionAuthMessageBody{
+		Message: text,
+	}
+
+	return c.SendOneWay(msg)
+}
+
+// reject sends a ConnectionAuth failure to the remote side and closes the connection
+func (c *connection) reject(code FabricErrorCode, text string) error {
+	err := c.sendConnectionAuth(code, text)
+	c.CloseWithError(&ConnectionAuthError{Code: code, Message: text})
+	return err
+}
+
+// authorize reads the first message and returns it for dispatching if the connection is accepted
+func (c *connection) authorize(authorizer ConnectionAuthorizer) (*ByteArrayMessage, error) {
+	if err := c.conn.SetReadDeadline(time.Now().Add(authorizeWaitTimeout)); err != nil {
+		return nil, err
+	}
+
+	for {
+		headers, body, err := c.nextMessageHeaderAndBodyFromFrame()
+		if err != nil {
+			return nil, err
+		}
+
+		msg := &ByteArrayMessage{
+			Headers: *headers,
+			Body:    body,
+		}
+
+		if headers.Actor == MessageActorTypeTransport {
+			if err := c.dispatch(msg); err != nil {
+				return nil, err
+			}
+
+			continue
+		}
+
+		role, err := authorizer(&ConnectionAuthInfo{
+			RemoteAddr:       c.conn.RemoteAddr(),
+			PeerCertificates: c.peerCertificates,
+			Claims:           c.claims,
+			FirstMessage:     msg,
+		})
+
+		if err != nil {
+			autherr := &ConnectionAuthError{
+				Code:    FabricErrorCodeAccessDenied,
+				Message: err.Error(),
+			}
+
+			errors.As(err, &autherr)
+
+			c.reject(autherr.Code, autherr.Message)
+			return nil, autherr
+		}
+
+		c.role = role
+
+		if err := c.conn.SetReadDeadline(time.Time{}); err != nil {
+			return nil, err
+		}
+
+		return msg, nil
+	}
+}
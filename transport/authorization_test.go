@@ -0,0 +1,115 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerAuthorizer(t *testing.T) {
+	network := NewMemoryNetwork()
+	server, err := ListenMemory(network, "auth:0", ServerConfig{
+		Authorizer: func(info *ConnectionAuthInfo) (RoleMask, error) {
+			switch info.FirstMessage.Headers.Action {
+			case "admin":
+				return RoleMaskAdmin, nil
+			case "user":
+				return RoleMaskUser, nil
+			case "busy":
+				return RoleMaskNone, &ConnectionAuthError{Code: FabricErrorCode(-2147467259), Message: "try later"}
+			}
+
+			return RoleMaskNone, fmt.Errorf("unknown action %v", info.FirstMessage.Headers.Action)
+		},
+		MessageCallback: func(c Conn, bam *ByteArrayMessage) {
+			msg := &Message{}
+			msg.Headers.RelatesTo = bam.Headers.Id
+			msg.Body = []byte(fmt.Sprint(c.(AuthorizedConn).Role()))
+
+			if err := c.SendOneWay(msg); err != nil {
+				t.Error(err)
+			}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	go server.Serve()
+
+	dial := func() *Client {
+		c, err := DialMemory(network, server.Addr().String(), ClientConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return c
+	}
+
+	for _, tc := range []struct {
+		action string
+		role   RoleMask
+	}{
+		{"admin", RoleMaskAdmin},
+		{"user", RoleMaskUser},
+	} {
+		t.Run(tc.action, func(t *testing.T) {
+			c := dial()
+			defer c.Close()
+			go c.Wait()
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			// first message is delivered after authorization
+			reply, err := c.RequestReply(ctx, &Message{
+				Headers: MessageHeaders{Action: tc.action},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			assert.Equal(t, fmt.Sprint(tc.role), string(reply.Body))
+		})
+	}
+
+	t.Run("rejected", func(t *testing.T) {
+		c := dial()
+		defer c.Close()
+
+		if err := c.SendOneWay(&Message{Headers: MessageHeaders{Action: "unknown"}}); err != nil {
+			t.Fatal(err)
+		}
+
+		var autherr *ConnectionAuthError
+		err := c.Wait()
+		if !errors.As(err, &autherr) {
+			t.Fatalf("expect ConnectionAuthError got %v", err)
+		}
+
+		assert.Equal(t, FabricErrorCodeAccessDenied, autherr.Code)
+		assert.Contains(t, autherr.Message, "unknown action")
+	})
+
+	t.Run("rejected with code", func(t *testing.T) {
+		c := dial()
+		defer c.Close()
+
+		if err := c.SendOneWay(&Message{Headers: MessageHeaders{Action: "busy"}}); err != nil {
+			t.Fatal(err)
+		}
+
+		var autherr *ConnectionAuthError
+		err := c.Wait()
+		if !errors.As(err, &autherr) {
+			t.Fatalf("expect ConnectionAuthError got %v", err)
+		}
+
+		assert.Equal(t, FabricErrorCode(-2147467259), autherr.Code)
+		assert.Equal(t, "try later", autherr.Message)
+	})
+}
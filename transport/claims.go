@@ -0,0 +1,86 @@
+package transport
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/tg123/phabrik/serialization"
+)
+
+// ClaimsRetriever returns the bearer token (AAD/dSTS) sent to the server when connecting
+type ClaimsRetriever func() (string, error)
+
+// ClaimsValidator validates the token sent by a client, a non nil error rejects the connection
+type ClaimsValidator func(token string) error
+
+const (
+	claimsMessageAction = "ClaimsMessage"
+
+	claimsWaitTimeout = 10 * time.Second
+)
+
+type claimsMessageBody struct {
+	Claims string
+}
+
+func (c *connection) sendClaims(retriever ClaimsRetriever) error {
+	token, err := retriever()
+	if err != nil {
+		return err
+	}
+
+	msg := c.msgfac.newMessage()
+	msg.Headers.Actor = MessageActorTypeSecurityContext
+	msg.Headers.Action = claimsMessageAction
+	msg.Headers.HighPriority = true
+	msg.Body = &claimsMessageBody{
+		Claims: token,
+	}
+
+	return c.SendOneWay(msg)
+}
+
+func (c *connection) acceptClaims(validator ClaimsValidator) error {
+	if err := c.conn.SetReadDeadline(time.Now().Add(claimsWaitTimeout)); err != nil {
+		return err
+	}
+
+	for {
+		headers, body, err := c.nextMessageHeaderAndBodyFromFrame()
+		if err != nil {
+			return err
+		}
+
+		// transport init may arrive before claims
+		if headers.Actor == MessageActorTypeTransport {
+			if err := c.dispatch(&ByteArrayMessage{Headers: *headers, Body: body}); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if headers.Actor != MessageActorTypeSecurityContext || headers.Action != claimsMessageAction {
+			c.sendConnectionAuth(FabricErrorCodeAccessDenied, "claims required")
+			return fmt.Errorf("expect claims message got actor [%v] action [%v]", headers.Actor, headers.Action)
+		}
+
+		var b claimsMessageBody
+		if err := serialization.Unmarshal(body, &b); err != nil {
+			return err
+		}
+
+		if err := validator(b.Claims); err != nil {
+			c.sendConnectionAuth(FabricErrorCodeAccessDenied, err.Error())
+			return fmt.Errorf("claims rejected: %v", err)
+		}
+
+		c.claims = b.Claims
+
+		if err := c.sendConnectionAuth(FabricErrorCodeSuccess, ""); err != nil {
+			return err
+		}
+
+		return c.conn.SetReadDeadline(time.Time{})
+	}
+}
@@ -0,0 +1,173 @@
+package transport
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testTokenIssuer stands in for AAD/dSTS, tokens are subject.expiry.hmac
+type testTokenIssuer struct {
+	key []byte
+}
+
+func (i *testTokenIssuer) sign(payload string) string {
+	m := hmac.New(sha256.New, i.key)
+	m.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(m.Sum(nil))
+}
+
+func (i *testTokenIssuer) issue(subject string, expiry time.Time) string {
+	payload := subject + "." + strconv.FormatInt(expiry.Unix(), 10)
+	return payload + "." + i.sign(payload)
+}
+
+func (i *testTokenIssuer) validate(token string) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("malformed token")
+	}
+
+	payload := parts[0] + "." + parts[1]
+	if !hmac.Equal([]byte(i.sign(payload)), []byte(parts[2])) {
+		return fmt.Errorf("bad signature")
+	}
+
+	exp, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return err
+	}
+
+	if time.Now().After(time.Unix(exp, 0)) {
+		return fmt.Errorf("token expired")
+	}
+
+	return nil
+}
+
+func TestClaimsServer(t *testing.T) {
+	cert, err := tls.X509KeyPair(testCertPem, testKeyPem)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	issuer := &testTokenIssuer{key: []byte("secret")}
+
+	network := NewMemoryNetwork()
+	server, err := ListenMemory(network, "claims:0", ServerConfig{
+		Config: Config{
+			TLS: &tls.Config{
+				Certificates: []tls.Certificate{cert},
+			},
+			ClaimsValidator: issuer.validate,
+		},
+		MessageCallback: func(c Conn, bam *ByteArrayMessage) {
+			msg := &Message{}
+			msg.Headers.RelatesTo = bam.Headers.Id
+			msg.Body = bam.Body
+
+			if err := c.SendOneWay(msg); err != nil {
+				t.Error(err)
+			}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	go server.Serve()
+
+	dial := func(token string) *Client {
+		conn, err := network.Dial(server.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c, err := Connect(conn, ClientConfig{
+			Config: Config{
+				TLS: &tls.Config{
+					InsecureSkipVerify: true,
+				},
+				ClaimsRetriever: func() (string, error) {
+					return token, nil
+				},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return c
+	}
+
+	t.Run("valid token", func(t *testing.T) {
+		c := dial(issuer.issue("user", time.Now().Add(time.Hour)))
+		defer c.Close()
+		go c.Wait()
+
+		reply, err := c.RequestReply(context.Background(), &Message{
+			Body: []byte{1, 2, 3},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assert.Equal(t, []byte{1, 2, 3}, reply.Body)
+	})
+
+	t.Run("expired token", func(t *testing.T) {
+		c := dial(issuer.issue("user", time.Now().Add(-time.Hour)))
+		defer c.Close()
+
+		err := c.Wait()
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "token expired")
+	})
+
+	t.Run("forged token", func(t *testing.T) {
+		forged := &testTokenIssuer{key: []byte("other")}
+		c := dial(forged.issue("user", time.Now().Add(time.Hour)))
+		defer c.Close()
+
+		err := c.Wait()
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "bad signature")
+	})
+
+	t.Run("no token", func(t *testing.T) {
+		conn, err := network.Dial(server.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c, err := Connect(conn, ClientConfig{
+			Config: Config{
+				TLS: &tls.Config{
+					InsecureSkipVerify: true,
+				},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+
+		go func() {
+			msg := &Message{}
+			msg.Headers.Actor = MessageActorTypeGenericTestActor
+			c.SendOneWay(msg)
+		}()
+
+		err = c.Wait()
+		assert.Error(t, err)
+	})
+}
@@ -23,6 +23,26 @@ func DialTCP(addr string, config ClientConfig) (*Client, error) {
 	return Connect(conn, config)
 }
 
+func DialUnix(path string, config ClientConfig) (*Client, error) {
+	conn, err := net.Dial("unix", path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return Connect(conn, config)
+}
+
+func DialMemory(network *MemoryNetwork, addr string, config ClientConfig) (*Client, error) {
+	conn, err := network.Dial(addr)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return Connect(conn, config)
+}
+
 func Connect(conn net.Conn, config ClientConfig) (*Client, error) {
 	c, err := tapClientConn(conn, config.Config)
 	if err != nil {
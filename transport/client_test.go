@@ -3,6 +3,8 @@ package transport
 import (
 	"bytes"
 	"context"
+	"errors"
+	"io"
 	"net"
 	"testing"
 	"time"
@@ -445,3 +447,84 @@ func TestTransportMessages(t *testing.T) {
 	})
 
 }
+
+func TestCloseWithError(t *testing.T) {
+	t.Run("peer eof", func(t *testing.T) {
+		p1, p2 := newMemoryConnPair(memoryAddr("a:1"), memoryAddr("b:1"))
+		c := mustTestConnection(t, p1)
+
+		result := make(chan error, 1)
+		go func() {
+			_, err := c.RequestReply(context.Background(), &Message{})
+			result <- err
+		}()
+
+		// wait request sent
+		_, _, err := nextFrame(p2, frameReadConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		p2.Close()
+
+		err = c.Wait()
+		assert.ErrorIs(t, err, io.EOF)
+		assert.ErrorIs(t, <-result, io.EOF)
+		assert.ErrorIs(t, c.Err(), io.EOF)
+
+		select {
+		case <-c.Done():
+		default:
+			t.Errorf("done should be closed")
+		}
+
+		assert.ErrorIs(t, c.SendOneWay(&Message{}), io.EOF)
+	})
+
+	t.Run("crc failure", func(t *testing.T) {
+		p1, p2 := newMemoryConnPair(memoryAddr("a:1"), memoryAddr("b:1"))
+		c := mustTestConnection(t, p1)
+		defer p2.Close()
+
+		result := make(chan error, 1)
+		go func() {
+			_, err := c.RequestReply(context.Background(), &Message{})
+			result <- err
+		}()
+
+		if _, _, err := nextFrame(p2, frameReadConfig{}); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := writeMessageWithFrame(p2, &Message{}, frameWriteConfig{}); err != nil {
+			t.Fatal(err)
+		}
+
+		var crcerr *FrameCRCError
+		assert.ErrorAs(t, c.Wait(), &crcerr)
+		assert.ErrorAs(t, <-result, &crcerr)
+	})
+
+	t.Run("custom cause", func(t *testing.T) {
+		p1, p2 := newMemoryConnPair(memoryAddr("a:1"), memoryAddr("b:1"))
+		c := mustTestConnection(t, p1)
+		defer p2.Close()
+
+		waitErr := make(chan error, 1)
+		go func() {
+			waitErr <- c.Wait()
+		}()
+
+		cause := errors.New("shutting down")
+		assert.NoError(t, c.CloseWithError(cause))
+		c.CloseWithError(errors.New("second cause ignored"))
+		c.Close()
+
+		<-c.Done()
+		assert.Equal(t, cause, <-waitErr)
+		assert.Equal(t, cause, c.Err())
+
+		_, err := c.Ping(context.Background())
+		assert.Equal(t, cause, err)
+	})
+}
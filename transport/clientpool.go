@@ -0,0 +1,341 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tg123/phabrik/common"
+)
+
+// BalancePolicy decides which connection of a ClientPool serves a request
+type BalancePolicy int
+
+const (
+	BalanceRoundRobin BalancePolicy = iota
+	BalanceLeastPending
+)
+
+const (
+	defaultHealthCheckInterval = 10 * time.Second
+	defaultHealthCheckTimeout  = 5 * time.Second
+)
+
+// ErrNoHealthyConnection is returned by ClientPool when all connections are broken
+var ErrNoHealthyConnection = errors.New("no healthy connection in pool")
+
+type ClientDialer func(addr string, config ClientConfig) (*Client, error)
+
+type ClientPoolConfig struct {
+	ClientConfig
+
+	// Endpoints are gateway addresses, connections are spread over them in order
+	Endpoints []string
+	// Size is the number of connections, len(Endpoints) if 0
+	Size int
+	// Dial creates connections, DialTCP if nil
+	Dial   ClientDialer
+	Policy BalancePolicy
+
+	// HealthCheckInterval is how often connections are pinged and broken ones redialed, 10s if 0
+	HealthCheckInterval time.Duration
+	// HealthCheckTimeout is the ping timeout, 5s if 0
+	HealthCheckTimeout time.Duration
+}
+
+type poolSlot struct {
+	endpoint string
+	lock     sync.Mutex
+	client   *Client
+}
+
+func (s *poolSlot) get() *Client {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.client
+}
+
+// ClientPool keeps a fixed number of connections to one or more gateways and balances requests over them
+type ClientPool struct {
+	config ClientPoolConfig
+	slots  []*poolSlot
+	next   uint32
+	logger common.Logger
+
+	callbackLock    sync.RWMutex
+	messageCallback MessageCallback
+
+	stickyLock sync.Mutex
+	sticky     *Client
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+var _ Conn = (*ClientPool)(nil)
+
+// NewClientPool dials all connections, it fails only if none of them can be established
+func NewClientPool(config ClientPoolConfig) (*ClientPool, error) {
+	if len(config.Endpoints) == 0 {
+		return nil, fmt.Errorf("no endpoint")
+	}
+
+	if config.Size <= 0 {
+		config.Size = len(config.Endpoints)
+	}
+
+	if config.Dial == nil {
+		config.Dial = DialTCP
+	}
+
+	if config.HealthCheckInterval <= 0 {
+		config.HealthCheckInterval = defaultHealthCheckInterval
+	}
+
+	if config.HealthCheckTimeout <= 0 {
+		config.HealthCheckTimeout = defaultHealthCheckTimeout
+	}
+
+	p := &ClientPool{
+		config:          config,
+		logger:          common.LoggerOrDefault(config.Logger),
+		messageCallback: config.MessageCallback,
+		done:            make(chan struct{}),
+	}
+
+	var lasterr error
+	for i := 0; i < config.Size; i++ {
+		s := &poolSlot{
+			endpoint: config.Endpoints[i%len(config.Endpoints)],
+		}
+
+		if err := p.dial(s); err != nil {
+			lasterr = err
+		}
+
+		p.slots = append(p.slots, s)
+	}
+
+	if len(p.Clients()) == 0 {
+		return nil, lasterr
+	}
+
+	go p.healthCheckLoop()
+
+	return p, nil
+}
+
+func (p *ClientPool) onMessage(conn Conn, msg *ByteArrayMessage) {
+	p.callbackLock.RLock()
+	cb := p.messageCallback
+	p.callbackLock.RUnlock()
+
+	if cb != nil {
+		cb(conn, msg)
+	}
+}
+
+// SetMessageCallback sets the callback of all connections, including redialed ones
+func (p *ClientPool) SetMessageCallback(cb MessageCallback) {
+	p.callbackLock.Lock()
+	defer p.callbackLock.Unlock()
+	p.messageCallback = cb
+}
+
+func (p *ClientPool) dial(s *poolSlot) error {
+	cfg := p.config.ClientConfig
+	cfg.MessageCallback = p.onMessage
+
+	c, err := p.config.Dial(s.endpoint, cfg)
+	if err != nil {
+		p.logger.Debug("pool dial failed", common.LogKeyConn, s.endpoint, common.LogKeyError, err)
+		return err
+	}
+
+	s.lock.Lock()
+	s.client = c
+	s.lock.Unlock()
+
+	// pool closed while dialing
+	select {
+	case <-p.done:
+		c.Close()
+	default:
+	}
+
+	go func() {
+		err := c.Wait()
+		p.evict(s, c, err)
+	}()
+
+	return nil
+}
+
+// evict removes a broken client from its slot, it is redialed on next health check
+func (p *ClientPool) evict(s *poolSlot, c *Client, err error) {
+	s.lock.Lock()
+	if s.client == c {
+		s.client = nil
+	}
+	s.lock.Unlock()
+
+	c.CloseWithError(err)
+	p.logger.Debug("pool connection evicted", common.LogKeyConn, s.endpoint, common.LogKeyError, err)
+}
+
+func (p *ClientPool) healthCheckLoop() {
+	t := time.NewTicker(p.config.HealthCheckInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-t.C:
+			p.healthCheck()
+		}
+	}
+}
+
+func (p *ClientPool) healthCheck() {
+	var wg sync.WaitGroup
+
+	for _, s := range p.slots {
+		wg.Add(1)
+		go func(s *poolSlot) {
+			defer wg.Done()
+
+			c := s.get()
+			if c == nil {
+				p.dial(s)
+				return
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), p.config.HealthCheckTimeout)
+			defer cancel()
+
+			if _, err := c.Ping(ctx); err != nil {
+				p.evict(s, c, err)
+			}
+		}(s)
+	}
+
+	wg.Wait()
+}
+
+// Clients returns healthy connections
+func (p *ClientPool) Clients() []*Client {
+	var clients []*Client
+	for _, s := range p.slots {
+		if c := s.get(); c != nil {
+			clients = append(clients, c)
+		}
+	}
+
+	return clients
+}
+
+func (p *ClientPool) pick() (*Client, error) {
+	select {
+	case <-p.done:
+		return nil, ErrOperationCancelled
+	default:
+	}
+
+	switch p.config.Policy {
+	case BalanceLeastPending:
+		var best *Client
+		var bestPending int64
+
+		for _, c := range p.Clients() {
+			pending := c.RequestTableStats().Pending
+			if best == nil || pending < bestPending {
+				best = c
+				bestPending = pending
+			}
+		}
+
+		if best != nil {
+			return best, nil
+		}
+	default:
+		n := len(p.slots)
+		start := int(atomic.AddUint32(&p.next, 1))
+		for i := 0; i < n; i++ {
+			if c := p.slots[(start+i)%n].get(); c != nil {
+				return c, nil
+			}
+		}
+	}
+
+	return nil, ErrNoHealthyConnection
+}
+
+// Sticky returns the same connection until it breaks, then picks another one.
+// It serves traffic whose state lives on one connection, e.g. naming notification filters.
+func (p *ClientPool) Sticky() (*Client, error) {
+	p.stickyLock.Lock()
+	defer p.stickyLock.Unlock()
+
+	if isClosedChan(p.done) {
+		return nil, ErrOperationCancelled
+	}
+
+	if p.sticky != nil && !isDone(p.sticky) {
+		return p.sticky, nil
+	}
+
+	// a closed client stays in its slot until evicted
+	for _, c := range p.Clients() {
+		if !isDone(c) {
+			p.sticky = c
+			return c, nil
+		}
+	}
+
+	return nil, ErrNoHealthyConnection
+}
+
+func (p *ClientPool) SendOneWay(message *Message) error {
+	c, err := p.pick()
+	if err != nil {
+		return err
+	}
+
+	return c.SendOneWay(message)
+}
+
+func (p *ClientPool) RequestReply(ctx context.Context, message *Message) (*ByteArrayMessage, error) {
+	c, err := p.pick()
+	if err != nil {
+		return nil, err
+	}
+
+	return c.RequestReply(ctx, message)
+}
+
+func (p *ClientPool) Ping(ctx context.Context) (time.Duration, error) {
+	c, err := p.pick()
+	if err != nil {
+		return -1, err
+	}
+
+	return c.Ping(ctx)
+}
+
+func (p *ClientPool) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.done)
+	})
+
+	for _, s := range p.slots {
+		if c := s.get(); c != nil {
+			c.Close()
+		}
+	}
+
+	return nil
+}
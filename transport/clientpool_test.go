@@ -0,0 +1,192 @@
+package transport
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientPool(t *testing.T) {
+	network := NewMemoryNetwork()
+
+	var lock sync.Mutex
+	served := make(map[string]int)
+
+	var endpoints []string
+	for i := 0; i < 2; i++ {
+		var addr string
+		server, err := ListenMemory(network, "gateway:0", ServerConfig{
+			MessageCallback: func(c Conn, bam *ByteArrayMessage) {
+				switch bam.Headers.Action {
+				case "kill":
+					c.Close()
+					return
+				case "hold":
+					return
+				}
+
+				lock.Lock()
+				served[addr]++
+				lock.Unlock()
+
+				msg := &Message{}
+				msg.Headers.RelatesTo = bam.Headers.Id
+				if err := c.SendOneWay(msg); err != nil {
+					t.Error(err)
+				}
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer server.Close()
+		go server.Serve()
+
+		addr = server.Addr().String()
+		endpoints = append(endpoints, addr)
+	}
+
+	newPool := func(t *testing.T, policy BalancePolicy) *ClientPool {
+		pool, err := NewClientPool(ClientPoolConfig{
+			Endpoints: append([]string{}, endpoints...),
+			Size:      4,
+			Policy:    policy,
+			Dial: func(addr string, config ClientConfig) (*Client, error) {
+				return DialMemory(network, addr, config)
+			},
+			HealthCheckInterval: 20 * time.Millisecond,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { pool.Close() })
+
+		return pool
+	}
+
+	request := func(pool *ClientPool, action string) error {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		msg := &Message{}
+		msg.Headers.Action = action
+		_, err := pool.RequestReply(ctx, msg)
+		return err
+	}
+
+	t.Run("round robin", func(t *testing.T) {
+		pool := newPool(t, BalanceRoundRobin)
+		assert.Len(t, pool.Clients(), 4)
+
+		lock.Lock()
+		served = make(map[string]int)
+		lock.Unlock()
+
+		for i := 0; i < 8; i++ {
+			assert.NoError(t, request(pool, "echo"))
+		}
+
+		lock.Lock()
+		defer lock.Unlock()
+		assert.Equal(t, 4, served[endpoints[0]])
+		assert.Equal(t, 4, served[endpoints[1]])
+	})
+
+	t.Run("evict and redial", func(t *testing.T) {
+		pool := newPool(t, BalanceRoundRobin)
+
+		msg := &Message{}
+		msg.Headers.Action = "kill"
+		assert.NoError(t, pool.SendOneWay(msg))
+
+		assert.Eventually(t, func() bool {
+			return len(pool.Clients()) == 3
+		}, time.Second, time.Millisecond)
+
+		for i := 0; i < 4; i++ {
+			assert.NoError(t, request(pool, "echo"))
+		}
+
+		assert.Eventually(t, func() bool {
+			return len(pool.Clients()) == 4
+		}, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("least pending", func(t *testing.T) {
+		pool := newPool(t, BalanceLeastPending)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		var wg sync.WaitGroup
+		for i := 0; i < 3; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				msg := &Message{}
+				msg.Headers.Action = "hold"
+				pool.RequestReply(ctx, msg)
+			}()
+
+			// each hold must be pending before picking the next
+			assert.Eventually(t, func() bool {
+				var pending int64
+				for _, c := range pool.Clients() {
+					pending += c.RequestTableStats().Pending
+				}
+				return pending == int64(i+1)
+			}, time.Second, time.Millisecond)
+		}
+
+		c, err := pool.pick()
+		assert.NoError(t, err)
+		assert.Equal(t, int64(0), c.RequestTableStats().Pending)
+
+		cancel()
+		wg.Wait()
+	})
+
+	t.Run("no endpoint reachable", func(t *testing.T) {
+		_, err := NewClientPool(ClientPoolConfig{
+			Endpoints: []string{"nowhere:1"},
+			Dial: func(addr string, config ClientConfig) (*Client, error) {
+				return DialMemory(network, addr, config)
+			},
+		})
+		assert.Error(t, err)
+	})
+
+	t.Run("sticky", func(t *testing.T) {
+		pool := newPool(t, BalanceRoundRobin)
+
+		c, err := pool.Sticky()
+		assert.NoError(t, err)
+
+		for i := 0; i < 4; i++ {
+			assert.NoError(t, request(pool, "echo"))
+
+			s, err := pool.Sticky()
+			assert.NoError(t, err)
+			assert.Same(t, c, s)
+		}
+
+		c.Close()
+
+		s, err := pool.Sticky()
+		assert.NoError(t, err)
+		assert.NotSame(t, c, s)
+	})
+
+	t.Run("closed", func(t *testing.T) {
+		pool := newPool(t, BalanceRoundRobin)
+		pool.Close()
+
+		assert.Error(t, request(pool, "echo"))
+
+		_, err := pool.Sticky()
+		assert.Error(t, err)
+	})
+}
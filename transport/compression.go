@@ -0,0 +1,67 @@
+package transport
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"sync"
+)
+
+const (
+	// connectionFeatureFlagDefault is what native Fabric sends in transport init
+	connectionFeatureFlagDefault uint32 = 1
+
+	// connectionFeatureFlagDeflate is a phabrik extension, native Fabric never sets it
+	connectionFeatureFlagDeflate uint32 = 1 << 31
+
+	// frameFlagCompressed is set in the frame security provider mask, which uses only the lower 3 bits
+	frameFlagCompressed uint8 = 0x80
+
+	// DefaultCompressionThreshold is used when Config.CompressionThreshold is 0
+	DefaultCompressionThreshold = 1024
+)
+
+var flateWriterPool = sync.Pool{
+	New: func() interface{} {
+		w, _ := flate.NewWriter(nil, flate.BestSpeed)
+		return w
+	},
+}
+
+// compressFrameBody deflates the body part of a marshaled message, headers are kept as is.
+// false is returned if the result is not smaller.
+func compressFrameBody(msg []byte, headerLen int) ([]byte, bool) {
+	var b bytes.Buffer
+	b.Write(msg[:headerLen])
+
+	w := flateWriterPool.Get().(*flate.Writer)
+	defer flateWriterPool.Put(w)
+
+	w.Reset(&b)
+	if _, err := w.Write(msg[headerLen:]); err != nil {
+		return nil, false
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, false
+	}
+
+	if b.Len() >= len(msg) {
+		return nil, false
+	}
+
+	return b.Bytes(), true
+}
+
+func decompressFrameBody(body []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(body))
+	defer r.Close()
+
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("decompress frame body: %w", err)
+	}
+
+	return b, nil
+}
@@ -0,0 +1,105 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompression(t *testing.T) {
+	payload := bytes.Repeat([]byte("fabric:/app/service "), 1000)
+
+	run := func(t *testing.T, serverCompression, clientCompression bool) *Client {
+		network := NewMemoryNetwork()
+		server, err := ListenMemory(network, "compression:0", ServerConfig{
+			Config: Config{
+				EnableCompression: serverCompression,
+			},
+			MessageCallback: func(c Conn, bam *ByteArrayMessage) {
+				msg := &Message{}
+				msg.Headers.RelatesTo = bam.Headers.Id
+				msg.Body = bam.Body
+
+				if err := c.SendOneWay(msg); err != nil {
+					t.Error(err)
+				}
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { server.Close() })
+		go server.Serve()
+
+		client, err := DialMemory(network, server.Addr().String(), ClientConfig{
+			Config: Config{
+				EnableCompression: clientCompression,
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { client.Close() })
+		go client.Wait()
+
+		// first request negotiates, peer init is handled concurrently
+		for i := 0; i < 3; i++ {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			reply, err := client.RequestReply(ctx, &Message{Body: payload})
+			cancel()
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			assert.Equal(t, payload, reply.Body)
+		}
+
+		return client
+	}
+
+	t.Run("negotiated", func(t *testing.T) {
+		c := run(t, true, true)
+		stats := c.Stats()
+		assert.Less(t, stats.BytesReceived, uint64(len(payload)))
+	})
+
+	t.Run("server only", func(t *testing.T) {
+		c := run(t, true, false)
+		assert.Greater(t, c.Stats().BytesReceived, uint64(3*len(payload)))
+	})
+
+	t.Run("client only", func(t *testing.T) {
+		c := run(t, false, true)
+		assert.Greater(t, c.Stats().BytesSent, uint64(3*len(payload)))
+	})
+}
+
+func TestCompressFrameBody(t *testing.T) {
+	msg := &Message{Body: bytes.Repeat([]byte{1, 2, 3, 4}, 1024)}
+
+	var buf bytes.Buffer
+	assert.NoError(t, writeMessageWithFrame(&buf, msg, frameWriteConfig{CompressThreshold: 1}))
+	assert.Less(t, buf.Len(), 4096)
+
+	raw := buf.Bytes()
+
+	_, _, err := nextMessageHeaderAndBodyFromFrame(bytes.NewReader(raw), frameReadConfig{})
+	assert.Error(t, err)
+
+	_, body, err := nextMessageHeaderAndBodyFromFrame(bytes.NewReader(raw), frameReadConfig{Decompress: true})
+	assert.NoError(t, err)
+	assert.Equal(t, msg.Body, body)
+
+	// incompressible body is sent as is
+	small := &Message{Body: []byte{1, 2, 3}}
+	buf.Reset()
+	assert.NoError(t, writeMessageWithFrame(&buf, small, frameWriteConfig{CompressThreshold: 1}))
+
+	_, body, err = nextMessageHeaderAndBodyFromFrame(&buf, frameReadConfig{})
+	assert.NoError(t, err)
+	assert.Equal(t, small.Body, body)
+}
@@ -3,11 +3,15 @@ package transport
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/tg123/phabrik/common"
 	"github.com/tg123/phabrik/serialization"
 )
 
@@ -19,6 +23,27 @@ type Config struct {
 	DisableGenerateFrameHeaderCRC bool
 	CheckFrameBodyCRC             bool
 	GenerateFrameBodyCRC          bool
+
+	// ClaimsRetriever enables claims based client authentication on top of TLS, client side only
+	ClaimsRetriever ClaimsRetriever
+	// ClaimsValidator requires clients to authenticate with a claims token, server side only
+	ClaimsValidator ClaimsValidator
+
+	// UncorrelatedReplyCallback receives replies matching no request sent on the connection,
+	// e.g. correlated by federation, they are counted and dropped if nil
+	UncorrelatedReplyCallback MessageCallback
+
+	// Observer receives metrics and traces of the connection
+	Observer Observer
+
+	// Logger only warnings and errors are written to log.Default() if nil
+	Logger common.Logger
+
+	// EnableCompression advertises deflate frame compression in transport init,
+	// bodies are only compressed after the peer advertises it too, native Fabric peers never do
+	EnableCompression bool
+	// CompressionThreshold is the min body size to compress, DefaultCompressionThreshold if 0
+	CompressionThreshold int
 }
 
 type Conn interface {
@@ -43,7 +68,20 @@ type connection struct {
 	frameWCfg frameWriteConfig
 
 	closeOnce sync.Once
-	fatalerr  error
+	done      chan struct{}
+	errLock   sync.Mutex
+	closeErr  error
+
+	role             RoleMask
+	peerCertificates []*x509.Certificate
+	claims           string
+
+	observer Observer
+	counters connectionCounters
+	logger   common.Logger
+
+	compressionThreshold int
+	peerCompression      int32
 }
 
 func newConnection(config Config) (*connection, error) {
@@ -53,8 +91,16 @@ func newConnection(config Config) (*connection, error) {
 	}
 
 	c := &connection{
-		msgfac: mf,
-		pingCh: make(chan int64),
+		msgfac:   mf,
+		pingCh:   make(chan int64, 1),
+		done:     make(chan struct{}),
+		role:     RoleMaskAdmin,
+		observer: config.Observer,
+		logger:   common.LoggerOrDefault(config.Logger),
+	}
+
+	if c.observer == nil {
+		c.observer = NopObserver{}
 	}
 
 	c.frameWCfg.SecurityProviderMask = securityProviderNone
@@ -63,6 +109,16 @@ func newConnection(config Config) (*connection, error) {
 	c.frameRCfg.CheckFrameBodyCRC = config.CheckFrameBodyCRC
 	c.frameWCfg.FrameBodyCRC = config.GenerateFrameBodyCRC
 
+	if config.EnableCompression {
+		c.frameRCfg.Decompress = true
+		c.compressionThreshold = config.CompressionThreshold
+		if c.compressionThreshold <= 0 {
+			c.compressionThreshold = DefaultCompressionThreshold
+		}
+	}
+
+	c.SetUncorrelatedReplyCallback(config.UncorrelatedReplyCallback)
+
 	return c, nil
 }
 
@@ -73,13 +129,21 @@ func tapAcceptedConn(conn net.Conn, config Config, initbuf []byte) (*connection,
 	}
 
 	if config.TLS != nil {
-		tlsconn, err := createTlsServerConn(conn, c.msgfac, config.TLS, initbuf)
+		provider := securityProviderSsl
+		if config.ClaimsValidator != nil {
+			provider = securityProviderClaims
+		}
+
+		tlsconn, err := createTlsServerConn(conn, c.msgfac, config.TLS, provider, initbuf)
 		if err != nil {
 			return nil, err
 		}
 
-		c.setTls()
+		c.setTls(provider)
 		c.conn = tlsconn
+		c.peerCertificates = tlsconn.ConnectionState().PeerCertificates
+	} else if config.ClaimsValidator != nil {
+		return nil, fmt.Errorf("claims authentication requires TLS")
 	} else {
 		c.conn = conn
 	}
@@ -88,6 +152,12 @@ func tapAcceptedConn(conn net.Conn, config Config, initbuf []byte) (*connection,
 		return nil, err
 	}
 
+	if config.ClaimsValidator != nil {
+		if err := c.acceptClaims(config.ClaimsValidator); err != nil {
+			return nil, err
+		}
+	}
+
 	return c, nil
 }
 
@@ -98,17 +168,31 @@ func tapClientConn(conn net.Conn, config Config) (*connection, error) {
 	}
 
 	if config.TLS != nil {
-		tlsconn, err := createTlsClientConn(conn, c.msgfac, config.TLS)
+		provider := securityProviderSsl
+		if config.ClaimsRetriever != nil {
+			provider = securityProviderClaims
+		}
+
+		tlsconn, err := createTlsClientConn(conn, c.msgfac, config.TLS, provider)
 		if err != nil {
 			return nil, err
 		}
 
-		c.setTls()
+		c.setTls(provider)
 		c.conn = tlsconn
+		c.peerCertificates = tlsconn.ConnectionState().PeerCertificates
+	} else if config.ClaimsRetriever != nil {
+		return nil, fmt.Errorf("claims authentication requires TLS")
 	} else {
 		c.conn = conn
 	}
 
+	if config.ClaimsRetriever != nil {
+		if err := c.sendClaims(config.ClaimsRetriever); err != nil {
+			return nil, err
+		}
+	}
+
 	if err := c.sendTransportInit(nil); err != nil {
 		return nil, err
 	}
@@ -116,29 +200,75 @@ func tapClientConn(conn net.Conn, config Config) (*connection, error) {
 	return c, nil
 }
 
-func (c *connection) setTls() {
+func (c *connection) setTls(provider securityProvider) {
 	c.frameRCfg.CheckFrameHeaderCRC = false
 	c.frameRCfg.CheckFrameBodyCRC = false
 	c.frameWCfg.FrameHeaderCRC = false
 	c.frameWCfg.FrameBodyCRC = false
-	c.frameWCfg.SecurityProviderMask = securityProviderSsl
+	c.frameWCfg.SecurityProviderMask = provider
+}
+
+// RequestTableStats returns counters of replies received on the connection
+func (c *connection) RequestTableStats() RequestTableStats {
+	return c.requestTable.Stats()
 }
 
 func (c *connection) SetMessageCallback(cb MessageCallback) {
 	c.messageCallback = cb
 }
 
+// SetUncorrelatedReplyCallback replaces Config.UncorrelatedReplyCallback, nil drops uncorrelated replies
+func (c *connection) SetUncorrelatedReplyCallback(cb MessageCallback) {
+	if cb == nil {
+		c.requestTable.UncorrelatedReplyCallback = nil
+		return
+	}
+
+	c.requestTable.UncorrelatedReplyCallback = func(msg *ByteArrayMessage) {
+		cb(c, msg)
+	}
+}
+
+// ErrOperationCancelled is the close cause of a connection closed by Close
+var ErrOperationCancelled = errors.New("operation cancelled")
+
 func (c *connection) Close() error {
-	err := c.conn.Close()
+	return c.CloseWithError(nil)
+}
+
+// CloseWithError closes the connection, pending requests, Wait and later calls fail with cause.
+// Only the first cause is kept, ErrOperationCancelled is used if cause is nil.
+func (c *connection) CloseWithError(cause error) error {
+	if cause == nil {
+		cause = ErrOperationCancelled
+	}
 
+	var err error
 	c.closeOnce.Do(func() {
-		close(c.pingCh)
-		c.requestTable.Close()
+		c.errLock.Lock()
+		c.closeErr = cause
+		c.errLock.Unlock()
+
+		close(c.done)
+		err = c.conn.Close()
+		c.requestTable.CloseWithError(cause)
 	})
 
 	return err
 }
 
+// Done is closed when the connection is closed
+func (c *connection) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns the close cause, nil if the connection is not closed
+func (c *connection) Err() error {
+	c.errLock.Lock()
+	defer c.errLock.Unlock()
+	return c.closeErr
+}
+
 type heartbeat struct {
 	HeartbeatTimeTick int64
 }
@@ -161,14 +291,26 @@ func (c *connection) Ping(ctx context.Context) (time.Duration, error) {
 		return -1, err
 	}
 
-	select {
-	case <-ctx.Done():
-		return -1, ctx.Err()
-	case t := <-c.pingCh:
-		if t != b.HeartbeatTimeTick {
-			return -1, fmt.Errorf("heartbeak time tick out of order")
+	for {
+		select {
+		case <-ctx.Done():
+			return -1, ctx.Err()
+		case <-c.done:
+			return -1, c.Err()
+		case t := <-c.pingCh:
+			if t < b.HeartbeatTimeTick {
+				// late response of a timed out ping
+				continue
+			}
+
+			if t != b.HeartbeatTimeTick {
+				return -1, fmt.Errorf("heartbeak time tick out of order")
+			}
+
+			rtt := time.Since(time.Unix(0, t))
+			c.observer.HeartbeatRTT(c.connInfo(), rtt)
+			return rtt, nil
 		}
-		return time.Since(time.Unix(0, t)), nil
 	}
 }
 
@@ -193,7 +335,11 @@ func (c *connection) handleTransportMessage(msg *ByteArrayMessage) error {
 			return err
 		}
 
-		c.pingCh <- b.HeartbeatTimeTick
+		select {
+		case c.pingCh <- b.HeartbeatTimeTick:
+		default:
+			// no one waiting, drop
+		}
 	default:
 	}
 	return nil
@@ -218,6 +364,11 @@ func (c *connection) sendTransportInit(conn net.Conn) error {
 		addr = conn.LocalAddr().String()
 	}
 
+	flags := connectionFeatureFlagDefault
+	if c.frameRCfg.Decompress {
+		flags |= connectionFeatureFlagDeflate
+	}
+
 	msg := c.msgfac.newMessage()
 	msg.Headers.Actor = MessageActorTypeTransport
 	msg.Headers.HighPriority = true
@@ -225,7 +376,7 @@ func (c *connection) sendTransportInit(conn net.Conn) error {
 		Address:                addr,
 		Nonce:                  nonce,
 		HeartbeatSupported:     true,
-		ConnectionFeatureFlags: 1,
+		ConnectionFeatureFlags: flags,
 	}
 
 	if err := c.SendOneWay(msg); err != nil {
@@ -235,68 +386,174 @@ func (c *connection) sendTransportInit(conn net.Conn) error {
 	return nil
 }
 
+func (c *connection) handleTransportInit(msg *ByteArrayMessage) error {
+	var b transportInitMessageBody
+
+	if err := serialization.Unmarshal(msg.Body, &b); err != nil {
+		// unknown init format, stay with default features
+		c.logger.Debug("transport init unmarshal failed", common.LogKeyConn, c.conn.RemoteAddr(), common.LogKeyError, err)
+		return nil
+	}
+
+	if c.frameRCfg.Decompress && b.ConnectionFeatureFlags&connectionFeatureFlagDeflate != 0 {
+		atomic.StoreInt32(&c.peerCompression, 1)
+	}
+
+	return nil
+}
+
 func (c *connection) writeMessageWithFrame(message *Message) error {
-	return writeMessageWithFrame(c.conn, message, c.frameWCfg)
+	cfg := c.frameWCfg
+	if atomic.LoadInt32(&c.peerCompression) != 0 {
+		cfg.CompressThreshold = c.compressionThreshold
+	}
+
+	w := &countingWriter{w: c.conn}
+	err := writeMessageWithFrame(w, message, cfg)
+
+	atomic.AddUint64(&c.counters.bytesSent, uint64(w.n))
+	if err == nil {
+		atomic.AddUint64(&c.counters.framesSent, 1)
+		c.observer.FrameSent(c.connInfo(), w.n)
+	}
+
+	return err
 }
 
 func (c *connection) nextMessageHeaderAndBodyFromFrame() (*MessageHeaders, []byte, error) {
-	return nextMessageHeaderAndBodyFromFrame(c.conn, c.frameRCfg)
+	r := &countingReader{r: c.conn}
+	headers, body, err := nextMessageHeaderAndBodyFromFrame(r, c.frameRCfg)
+
+	atomic.AddUint64(&c.counters.bytesReceived, uint64(r.n))
+
+	var crcerr *FrameCRCError
+	if errors.As(err, &crcerr) {
+		atomic.AddUint64(&c.counters.crcFailures, 1)
+		c.observer.CRCFailure(c.connInfo(), err)
+	}
+
+	if err == nil {
+		atomic.AddUint64(&c.counters.framesReceived, 1)
+		c.observer.FrameReceived(c.connInfo(), r.n)
+	}
+
+	return headers, body, err
 }
 
-func (c *connection) Wait() error {
-	defer c.Close()
+func (c *connection) connInfo() ConnInfo {
+	return ConnInfo{
+		LocalAddr:  c.conn.LocalAddr(),
+		RemoteAddr: c.conn.RemoteAddr(),
+	}
+}
+
+// Stats returns bytes and frames counters of the connection
+func (c *connection) Stats() ConnectionStats {
+	return c.counters.stats()
+}
 
+// Wait dispatches messages until the connection is closed, it returns the close cause
+func (c *connection) Wait() error {
 	for {
 		headers, body, err := c.nextMessageHeaderAndBodyFromFrame()
 		if err != nil {
-			return err
+			c.CloseWithError(err)
+			return c.Err()
 		}
 
-		msg := &ByteArrayMessage{
+		if err := c.dispatch(&ByteArrayMessage{
 			Headers: *headers,
 			Body:    body,
+		}); err != nil {
+			c.CloseWithError(err)
+			return c.Err()
 		}
+	}
+}
+
+func (c *connection) dispatch(msg *ByteArrayMessage) error {
+	headers := &msg.Headers
 
-		if headers.Actor == MessageActorTypeTransport {
-			go c.handleTransportMessage(msg)
-			continue
+	if headers.Actor == MessageActorTypeTransport {
+		// init is handled in order so that features apply to replies of following messages
+		if headers.Action == "" {
+			return c.handleTransportInit(msg)
 		}
 
-		// TODO support server side reject
-		if headers.Actor == MessageActorTypeTransportSendTarget && headers.Action == "ConnectionAuth" {
-			if headers.ErrorCode != FabricErrorCodeSuccess {
-				var b struct {
-					Message string
-				}
+		go func() {
+			if err := c.handleTransportMessage(msg); err != nil {
+				c.logger.Debug("handle transport message failed", common.LogKeyConn, c.conn.RemoteAddr(), common.LogKeyMessageId, headers.Id, common.LogKeyError, err)
+			}
+		}()
+		return nil
+	}
 
-				serialization.Unmarshal(body, &b) // ignore error
-				c.fatalerr = fmt.Errorf("connection auth failure, error code [%v], msg [%v]", headers.ErrorCode, b.Message)
+	if headers.Actor == MessageActorTypeTransportSendTarget && headers.Action == connectionAuthAction {
+		if headers.ErrorCode != FabricErrorCodeSuccess {
+			var b connectionAuthMessageBody
 
-				return c.Close()
+			serialization.Unmarshal(msg.Body, &b) // ignore error
+			return &ConnectionAuthError{
+				Code:    headers.ErrorCode,
+				Message: b.Message,
 			}
 		}
 
-		if !c.requestTable.Feed(msg) {
-			if c.messageCallback != nil {
-				c.messageCallback(c, msg)
-			}
+		return nil
+	}
+
+	if !c.requestTable.Feed(msg) {
+		if c.messageCallback != nil {
+			c.messageCallback(c, msg)
 		}
 	}
+
+	return nil
 }
 
 func (c *connection) SendOneWay(message *Message) error {
-	if c.fatalerr != nil {
-		return c.fatalerr
+	if err := c.Err(); err != nil {
+		return err
 	}
 	c.msgfac.fillMessageId(message)
 	return c.writeMessageWithFrame(message)
 }
 
 func (c *connection) RequestReply(ctx context.Context, message *Message) (*ByteArrayMessage, error) {
+	ApplyActivity(ctx, &message.Headers)
+
+	start := time.Now()
+	reply, err := c.requestReply(ctx, message)
+
+	trace := RequestTrace{
+		Actor:     message.Headers.Actor,
+		Action:    message.Headers.Action,
+		Start:     start,
+		Latency:   time.Since(start),
+		ErrorCode: ErrorCodeOf(err),
+		Err:       err,
+	}
+
+	trace.ActivityId, _ = message.Headers.FabricActivity()
+	if reply != nil {
+		trace.ErrorCode = reply.Headers.ErrorCode
+	}
+
+	c.observer.RequestCompleted(c.connInfo(), trace)
+
+	return reply, err
+}
+
+func (c *connection) requestReply(ctx context.Context, message *Message) (*ByteArrayMessage, error) {
 	c.msgfac.fillMessageId(message)
 	message.Headers.ExpectsReply = true
 	pr := c.requestTable.Put(message)
-	defer pr.Close()
+	c.observer.PendingRequests(c.connInfo(), c.requestTable.Stats().Pending)
+
+	defer func() {
+		pr.Close()
+		c.observer.PendingRequests(c.connInfo(), c.requestTable.Stats().Pending)
+	}()
 
 	if err := c.SendOneWay(message); err != nil {
 		return nil, err
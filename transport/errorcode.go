@@ -1,8 +1,67 @@
 package transport
 
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
 type FabricErrorCode int64
 
 // TODO import errorcodevalue.h
 const (
 	FabricErrorCodeSuccess FabricErrorCode = 0
+
+	// values are HRESULT as int32
+	FabricErrorCodeFail                   FabricErrorCode = -2147467259 // E_FAIL 0x80004005
+	FabricErrorCodeAccessDenied           FabricErrorCode = -2147024891 // E_ACCESSDENIED 0x80070005
+	FabricErrorCodeOperationCanceled      FabricErrorCode = -2147467260 // E_ABORT 0x80004004
+	FabricErrorCodeTimeout                FabricErrorCode = -2147023436 // FABRIC_E_TIMEOUT 0x800705B4
+	FabricErrorCodeCommunicationError     FabricErrorCode = -2147017796 // FABRIC_E_COMMUNICATION_ERROR 0x80071BBC
+	FabricErrorCodeNotPrimary             FabricErrorCode = -2147017786 // FABRIC_E_NOT_PRIMARY 0x80071BC6
+	FabricErrorCodeNotReady               FabricErrorCode = -2147017785 // FABRIC_E_NOT_READY 0x80071BC7
+	FabricErrorCodeReconfigurationPending FabricErrorCode = -2147017782 // FABRIC_E_RECONFIGURATION_PENDING 0x80071BCA
+	FabricErrorCodeServiceDoesNotExist    FabricErrorCode = -2147017779 // FABRIC_E_SERVICE_DOES_NOT_EXIST 0x80071BCD
+	FabricErrorCodeServiceOffline         FabricErrorCode = -2147017778 // FABRIC_E_SERVICE_OFFLINE 0x80071BCE
 )
+
+// FabricError is an error carrying a FabricErrorCode, e.g. the ErrorCode header of a reply
+type FabricError struct {
+	Code    FabricErrorCode
+	Message string
+}
+
+func (e *FabricError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("fabric error code [%v], msg [%v]", e.Code, e.Message)
+	}
+
+	return fmt.Sprintf("fabric error code [%v]", e.Code)
+}
+
+// ErrorCodeOf maps an error returned by transport to a FabricErrorCode
+func ErrorCodeOf(err error) FabricErrorCode {
+	if err == nil {
+		return FabricErrorCodeSuccess
+	}
+
+	var fe *FabricError
+	if errors.As(err, &fe) {
+		return fe.Code
+	}
+
+	var ae *ConnectionAuthError
+	if errors.As(err, &ae) {
+		return ae.Code
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return FabricErrorCodeTimeout
+	}
+
+	if errors.Is(err, context.Canceled) {
+		return FabricErrorCodeOperationCanceled
+	}
+
+	return FabricErrorCodeCommunicationError
+}
@@ -0,0 +1,236 @@
+package transport
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/tg123/phabrik/common"
+)
+
+func init() {
+	RegisterHeaderActivator(MessageHeaderIdTypeFabricTransportMessageHeader, func() interface{} {
+		return &FabricTransportMessageHeader{}
+	})
+}
+
+// FabricTransportMessageHeader tells how many bytes at the beginning of the body are the user header,
+// the rest is the user body, as used by Reliable Services remoting V2
+type FabricTransportMessageHeader struct {
+	HeaderSize uint32
+}
+
+func (h *MessageHeaders) FabricTransport() (FabricTransportMessageHeader, bool) {
+	v, ok := h.GetFirstCustomHeader(MessageHeaderIdTypeFabricTransportMessageHeader)
+	if !ok {
+		return FabricTransportMessageHeader{}, false
+	}
+
+	fh, ok := v.(*FabricTransportMessageHeader)
+	if !ok {
+		return FabricTransportMessageHeader{}, false
+	}
+
+	return *fh, true
+}
+
+func (h *MessageHeaders) SetFabricTransport(header FabricTransportMessageHeader) {
+	h.ReplaceCustomHeader(MessageHeaderIdTypeFabricTransportMessageHeader, &header)
+}
+
+// FabricTransportMessage is a remoting message, Header and Body are opaque to transport
+type FabricTransportMessage struct {
+	Header []byte
+	Body   []byte
+}
+
+func (m *FabricTransportMessage) toMessage() *Message {
+	body := make([]byte, 0, len(m.Header)+len(m.Body))
+	body = append(body, m.Header...)
+	body = append(body, m.Body...)
+
+	msg := &Message{Body: body}
+	msg.Headers.Actor = MessageActorTypeServiceCommunicationActor
+	msg.Headers.SetFabricTransport(FabricTransportMessageHeader{
+		HeaderSize: uint32(len(m.Header)),
+	})
+
+	return msg
+}
+
+func fabricTransportMessageFrom(bam *ByteArrayMessage) (*FabricTransportMessage, error) {
+	h, ok := bam.Headers.FabricTransport()
+	if !ok {
+		return &FabricTransportMessage{Body: bam.Body}, nil
+	}
+
+	if int(h.HeaderSize) > len(bam.Body) {
+		return nil, fmt.Errorf("fabric transport header size %v larger than body %v", h.HeaderSize, len(bam.Body))
+	}
+
+	return &FabricTransportMessage{
+		Header: bam.Body[:h.HeaderSize],
+		Body:   bam.Body[h.HeaderSize:],
+	}, nil
+}
+
+// FabricTransportRequestHandler serves a request, return a *FabricError to control the error code sent back
+type FabricTransportRequestHandler func(ctx context.Context, request *FabricTransportMessage) (*FabricTransportMessage, error)
+
+type FabricTransportOneWayHandler func(message *FabricTransportMessage)
+
+type FabricTransportListenerConfig struct {
+	Config
+	// ServiceLocation is the ServiceLocationActor clients address, "" serves clients sending none
+	ServiceLocation string
+	RequestHandler  FabricTransportRequestHandler
+	OneWayHandler   FabricTransportOneWayHandler
+}
+
+// FabricTransportListener hosts a remoting compatible endpoint on a ServiceCommunicationListener
+type FabricTransportListener struct {
+	*ServiceCommunicationListener
+}
+
+func ListenFabricTransport(l net.Listener, config FabricTransportListenerConfig) (*FabricTransportListener, error) {
+	s, err := ListenServiceCommunication(l, ServiceCommunicationListenerConfig{
+		Config: config.Config,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.RegisterFabricTransport(config.ServiceLocation, config.RequestHandler, config.OneWayHandler); err != nil {
+		return nil, err
+	}
+
+	return &FabricTransportListener{s}, nil
+}
+
+// RegisterFabricTransport serves remoting messages at a service location, next to other locations of the listener
+func (s *ServiceCommunicationListener) RegisterFabricTransport(location string, requestHandler FabricTransportRequestHandler, oneWayHandler FabricTransportOneWayHandler) error {
+	if requestHandler == nil {
+		return fmt.Errorf("RequestHandler must not be nil")
+	}
+
+	oneWay := func(clientId string, bam *ByteArrayMessage) {
+		if oneWayHandler == nil {
+			return
+		}
+
+		message, err := fabricTransportMessageFrom(bam)
+		if err != nil {
+			s.logger.Debug("fabric transport one way message dropped", common.LogKeyMessageId, bam.Headers.Id, common.LogKeyError, err)
+			return
+		}
+
+		oneWayHandler(message)
+	}
+
+	return s.Register(location, ServiceLocationHandler{
+		RequestHandler: func(ctx context.Context, clientId string, bam *ByteArrayMessage) (*Message, error) {
+			// clients without TcpServiceMessageHeader send one way messages as requests expecting no reply
+			if !bam.Headers.ExpectsReply {
+				oneWay(clientId, bam)
+				return nil, nil
+			}
+
+			request, err := fabricTransportMessageFrom(bam)
+			if err != nil {
+				return nil, err
+			}
+
+			reply, err := requestHandler(ctx, request)
+			if err != nil {
+				return nil, err
+			}
+
+			if reply == nil {
+				reply = &FabricTransportMessage{}
+			}
+
+			return reply.toMessage(), nil
+		},
+		OneWayHandler: oneWay,
+	})
+}
+
+type FabricTransportClientConfig struct {
+	Config
+	// ServiceLocation is the ServiceLocationActor of the remote FabricTransportListener
+	ServiceLocation string
+	// ClientId is generated if empty
+	ClientId string
+	// DefaultTimeout is used when the request ctx has no deadline, sent in the Timeout header
+	DefaultTimeout time.Duration
+}
+
+// FabricTransportClient calls a remoting compatible endpoint over a ServiceCommunicationClient
+type FabricTransportClient struct {
+	client *ServiceCommunicationClient
+	config FabricTransportClientConfig
+}
+
+func DialFabricTransport(addr string, config FabricTransportClientConfig) (*FabricTransportClient, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewFabricTransportClient(conn, config)
+}
+
+func NewFabricTransportClient(conn net.Conn, config FabricTransportClientConfig) (*FabricTransportClient, error) {
+	client, err := NewServiceCommunicationClient(conn, ServiceCommunicationClientConfig{
+		Config:          config.Config,
+		ServiceLocation: config.ServiceLocation,
+		ClientId:        config.ClientId,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &FabricTransportClient{
+		client: client,
+		config: config,
+	}, nil
+}
+
+func (c *FabricTransportClient) ClientId() string {
+	return c.client.ClientId()
+}
+
+// Connect registers the client at the service location so that the listener can track it
+func (c *FabricTransportClient) Connect(ctx context.Context) error {
+	return c.client.Connect(ctx)
+}
+
+// RequestResponse sends a request and waits for its reply,
+// a failed request is returned as *FabricError with the error text from the remote side
+func (c *FabricTransportClient) RequestResponse(ctx context.Context, request *FabricTransportMessage) (*FabricTransportMessage, error) {
+	if _, ok := ctx.Deadline(); !ok && c.config.DefaultTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.config.DefaultTimeout)
+		defer cancel()
+	}
+
+	reply, err := c.client.RequestReply(ctx, request.toMessage())
+	if err != nil {
+		return nil, err
+	}
+
+	return fabricTransportMessageFrom(reply)
+}
+
+func (c *FabricTransportClient) SendOneWay(message *FabricTransportMessage) error {
+	return c.client.SendOneWay(message.toMessage())
+}
+
+func (c *FabricTransportClient) Wait() error {
+	return c.client.Wait()
+}
+
+func (c *FabricTransportClient) Close() error {
+	return c.client.Close()
+}
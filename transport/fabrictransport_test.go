@@ -0,0 +1,186 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFabricTransport(t *testing.T) {
+	network := NewMemoryNetwork()
+	l, err := network.Listen("remoting:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oneway := make(chan *FabricTransportMessage, 1)
+
+	listener, err := ListenFabricTransport(l, FabricTransportListenerConfig{
+		RequestHandler: func(ctx context.Context, request *FabricTransportMessage) (*FabricTransportMessage, error) {
+			if _, ok := ctx.Deadline(); !ok {
+				return nil, errors.New("timeout not propagated")
+			}
+
+			switch string(request.Header) {
+			case "fail":
+				return nil, &FabricError{Code: FabricErrorCodeNotReady, Message: "replica not ready"}
+			case "panic":
+				return nil, errors.New("boom")
+			}
+
+			return &FabricTransportMessage{
+				Header: request.Header,
+				Body:   bytes.ToUpper(request.Body),
+			}, nil
+		},
+		OneWayHandler: func(message *FabricTransportMessage) {
+			oneway <- message
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go listener.Serve()
+
+	conn, err := network.Dial(listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := NewFabricTransportClient(conn, FabricTransportClientConfig{
+		DefaultTimeout: time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	go client.Wait()
+
+	t.Run("request response", func(t *testing.T) {
+		reply, err := client.RequestResponse(context.Background(), &FabricTransportMessage{
+			Header: []byte("header"),
+			Body:   []byte("body"),
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("header"), reply.Header)
+		assert.Equal(t, []byte("BODY"), reply.Body)
+	})
+
+	t.Run("error code", func(t *testing.T) {
+		_, err := client.RequestResponse(context.Background(), &FabricTransportMessage{
+			Header: []byte("fail"),
+		})
+
+		var fe *FabricError
+		if !errors.As(err, &fe) {
+			t.Fatalf("expect FabricError got %v", err)
+		}
+
+		assert.Equal(t, FabricErrorCodeNotReady, fe.Code)
+		assert.Contains(t, fe.Message, "replica not ready")
+	})
+
+	t.Run("generic error", func(t *testing.T) {
+		_, err := client.RequestResponse(context.Background(), &FabricTransportMessage{
+			Header: []byte("panic"),
+		})
+
+		var fe *FabricError
+		if !errors.As(err, &fe) {
+			t.Fatalf("expect FabricError got %v", err)
+		}
+
+		assert.Equal(t, FabricErrorCodeFail, fe.Code)
+		assert.Equal(t, "boom", fe.Message)
+	})
+
+	t.Run("one way", func(t *testing.T) {
+		assert.NoError(t, client.SendOneWay(&FabricTransportMessage{
+			Header: []byte("h"),
+			Body:   []byte("b"),
+		}))
+
+		select {
+		case m := <-oneway:
+			assert.Equal(t, []byte("h"), m.Header)
+			assert.Equal(t, []byte("b"), m.Body)
+		case <-time.After(time.Second):
+			t.Fatal("one way message not received")
+		}
+	})
+}
+
+func TestFabricTransportServiceLocation(t *testing.T) {
+	network := NewMemoryNetwork()
+	l, err := network.Listen("remoting:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := ListenServiceCommunication(l, ServiceCommunicationListenerConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go listener.Serve()
+
+	assert.NoError(t, listener.RegisterFabricTransport("remoting", func(ctx context.Context, request *FabricTransportMessage) (*FabricTransportMessage, error) {
+		return &FabricTransportMessage{Header: request.Header, Body: []byte("remoting")}, nil
+	}, nil))
+	assert.NoError(t, listener.Register("plain", ServiceLocationHandler{
+		RequestHandler: func(ctx context.Context, clientId string, request *ByteArrayMessage) (*Message, error) {
+			return &Message{Body: []byte("plain")}, nil
+		},
+	}))
+	assert.Error(t, listener.RegisterFabricTransport("plain", func(ctx context.Context, request *FabricTransportMessage) (*FabricTransportMessage, error) {
+		return nil, nil
+	}, nil))
+
+	dial := func(location string) *FabricTransportClient {
+		conn, err := network.Dial(listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		client, err := NewFabricTransportClient(conn, FabricTransportClientConfig{
+			ServiceLocation: location,
+			DefaultTimeout:  time.Second,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { client.Close() })
+		go client.Wait()
+
+		return client
+	}
+
+	t.Run("routed by location", func(t *testing.T) {
+		reply, err := dial("remoting").RequestResponse(context.Background(), &FabricTransportMessage{Header: []byte("h")})
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("h"), reply.Header)
+		assert.Equal(t, []byte("remoting"), reply.Body)
+	})
+
+	t.Run("connect", func(t *testing.T) {
+		client := dial("remoting")
+		assert.NoError(t, client.Connect(context.Background()))
+		assert.Contains(t, listener.Clients("remoting"), client.ClientId())
+	})
+
+	t.Run("unknown location", func(t *testing.T) {
+		_, err := dial("missing").RequestResponse(context.Background(), &FabricTransportMessage{})
+
+		var fe *FabricError
+		if !errors.As(err, &fe) {
+			t.Fatalf("expect FabricError got %v", err)
+		}
+
+		assert.Equal(t, FabricErrorCodeServiceDoesNotExist, fe.Code)
+	})
+}
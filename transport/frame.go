@@ -34,6 +34,17 @@ var sizeOfFrameheader = binary.Size(frameheader{})
 type frameReadConfig struct {
 	CheckFrameHeaderCRC bool
 	CheckFrameBodyCRC   bool
+	// Decompress accepts frames with compressed body
+	Decompress bool
+}
+
+// FrameCRCError is returned when a received frame fails crc check
+type FrameCRCError struct {
+	Part string
+}
+
+func (e *FrameCRCError) Error() string {
+	return fmt.Sprintf("frame %v check fail", e.Part)
 }
 
 func nextFrame(r io.Reader, config frameReadConfig) (*frameheader, []byte, error) {
@@ -57,7 +68,7 @@ func nextFrame(r io.Reader, config frameReadConfig) (*frameheader, []byte, error
 
 	if config.CheckFrameHeaderCRC {
 		if header.FrameHeaderCRC != crc8.Checksum(b.Bytes(), crc8.MakeTable(crc8.CRC8)) {
-			return nil, nil, fmt.Errorf("frame header crc8 check fail")
+			return nil, nil, &FrameCRCError{Part: "header crc8"}
 		}
 	}
 
@@ -70,7 +81,7 @@ func nextFrame(r io.Reader, config frameReadConfig) (*frameheader, []byte, error
 
 	if config.CheckFrameBodyCRC {
 		if header.FrameBodyCRC != crc32.Checksum(body, crc32.IEEETable) {
-			return nil, nil, fmt.Errorf("frame body crc32 check fail")
+			return nil, nil, &FrameCRCError{Part: "body crc32"}
 		}
 	}
 
@@ -83,6 +94,8 @@ type frameWriteConfig struct {
 	SecurityProviderMask securityProvider
 	FrameHeaderCRC       bool
 	FrameBodyCRC         bool
+	// CompressThreshold compresses message bodies not smaller than it, 0 disables compression
+	CompressThreshold int
 }
 
 func writeFrame(w io.Writer, headerLen int, msg []byte, config frameWriteConfig) error {
@@ -0,0 +1,233 @@
+package transport
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+func init() {
+	RegisterHeaderActivator(MessageHeaderIdTypeIpc, func() interface{} {
+		return &IpcHeader{}
+	})
+}
+
+// IpcHeader identifies the sending IpcClient, it is attached to every message from an IpcClient
+type IpcHeader struct {
+	From          string
+	FromProcessId uint32
+}
+
+func (h *MessageHeaders) Ipc() (IpcHeader, bool) {
+	v, ok := h.GetFirstCustomHeader(MessageHeaderIdTypeIpc)
+	if !ok {
+		return IpcHeader{}, false
+	}
+
+	ih, ok := v.(*IpcHeader)
+	if !ok {
+		return IpcHeader{}, false
+	}
+
+	return *ih, true
+}
+
+func (h *MessageHeaders) SetIpc(header IpcHeader) {
+	h.ReplaceCustomHeader(MessageHeaderIdTypeIpc, &header)
+}
+
+type IpcClientConfig struct {
+	Config
+	ClientId        string
+	ProcessId       uint32
+	MessageCallback MessageCallback
+}
+
+// IpcClient is the local peer of an IpcServer, such as an application host talking to Fabric.exe
+type IpcClient struct {
+	client *Client
+	header IpcHeader
+}
+
+var _ Conn = (*IpcClient)(nil)
+
+func DialIpc(network, addr string, config IpcClientConfig) (*IpcClient, error) {
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewIpcClient(conn, config)
+}
+
+func NewIpcClient(conn net.Conn, config IpcClientConfig) (*IpcClient, error) {
+	if config.ClientId == "" {
+		return nil, fmt.Errorf("ClientId must not be empty")
+	}
+
+	if config.ProcessId == 0 {
+		config.ProcessId = uint32(os.Getpid())
+	}
+
+	c := &IpcClient{
+		header: IpcHeader{
+			From:          config.ClientId,
+			FromProcessId: config.ProcessId,
+		},
+	}
+
+	var cb MessageCallback
+	if config.MessageCallback != nil {
+		cb = func(_ Conn, bam *ByteArrayMessage) {
+			config.MessageCallback(c, bam)
+		}
+	}
+
+	client, err := Connect(conn, ClientConfig{
+		Config:          config.Config,
+		MessageCallback: cb,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	c.client = client
+	return c, nil
+}
+
+func (c *IpcClient) ClientId() string {
+	return c.header.From
+}
+
+func (c *IpcClient) SendOneWay(message *Message) error {
+	message.Headers.SetIpc(c.header)
+	return c.client.SendOneWay(message)
+}
+
+func (c *IpcClient) RequestReply(ctx context.Context, message *Message) (*ByteArrayMessage, error) {
+	message.Headers.SetIpc(c.header)
+	return c.client.RequestReply(ctx, message)
+}
+
+func (c *IpcClient) Ping(ctx context.Context) (time.Duration, error) {
+	return c.client.Ping(ctx)
+}
+
+func (c *IpcClient) Wait() error {
+	return c.client.Wait()
+}
+
+func (c *IpcClient) Close() error {
+	return c.client.Close()
+}
+
+type IpcServerConfig struct {
+	Config
+	MessageCallback MessageCallback
+}
+
+// IpcServer accepts IpcClients and keeps track of their connections by client id
+type IpcServer struct {
+	server          *Server
+	clients         sync.Map
+	messageCallback MessageCallback
+}
+
+func ListenIpc(network, addr string, config IpcServerConfig) (*IpcServer, error) {
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewIpcServer(l, config)
+}
+
+func NewIpcServer(l net.Listener, config IpcServerConfig) (*IpcServer, error) {
+	s := &IpcServer{
+		messageCallback: config.MessageCallback,
+	}
+
+	server, err := Listen(l, ServerConfig{
+		Config:             config.Config,
+		MessageCallback:    s.onMessage,
+		DisconnectCallback: s.onDisconnect,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.server = server
+	return s, nil
+}
+
+func (s *IpcServer) onMessage(conn Conn, msg *ByteArrayMessage) {
+	if h, ok := msg.Headers.Ipc(); ok {
+		s.clients.Store(h.From, conn)
+	}
+
+	if s.messageCallback != nil {
+		s.messageCallback(conn, msg)
+	}
+}
+
+func (s *IpcServer) onDisconnect(conn Conn, err error) {
+	s.clients.Range(func(key, value interface{}) bool {
+		if value == conn {
+			s.clients.Delete(key)
+		}
+		return true
+	})
+}
+
+func (s *IpcServer) Addr() net.Addr {
+	return s.server.Addr()
+}
+
+func (s *IpcServer) client(clientId string) (Conn, error) {
+	c, ok := s.clients.Load(clientId)
+	if !ok {
+		return nil, fmt.Errorf("ipc client %v not connected", clientId)
+	}
+
+	return c.(Conn), nil
+}
+
+// Clients returns ids of clients which have sent at least one message
+func (s *IpcServer) Clients() []string {
+	var ids []string
+	s.clients.Range(func(key, value interface{}) bool {
+		ids = append(ids, key.(string))
+		return true
+	})
+
+	return ids
+}
+
+func (s *IpcServer) SendOneWay(clientId string, message *Message) error {
+	c, err := s.client(clientId)
+	if err != nil {
+		return err
+	}
+
+	return c.SendOneWay(message)
+}
+
+func (s *IpcServer) RequestReply(ctx context.Context, clientId string, message *Message) (*ByteArrayMessage, error) {
+	c, err := s.client(clientId)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.RequestReply(ctx, message)
+}
+
+func (s *IpcServer) Serve() error {
+	return s.server.Serve()
+}
+
+func (s *IpcServer) Close() error {
+	return s.server.Close()
+}
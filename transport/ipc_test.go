@@ -0,0 +1,102 @@
+package transport
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIpcRequestReply(t *testing.T) {
+	network := NewMemoryNetwork()
+
+	l, err := network.Listen("ipc:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := NewIpcServer(l, IpcServerConfig{
+		MessageCallback: func(c Conn, bam *ByteArrayMessage) {
+			h, ok := bam.Headers.Ipc()
+			assert.True(t, ok)
+			assert.Equal(t, "client1", h.From)
+			assert.Equal(t, uint32(1234), h.FromProcessId)
+
+			msg := &Message{}
+			msg.Headers.RelatesTo = bam.Headers.Id
+			msg.Headers.Actor = MessageActorTypeIpcTestActor1
+			msg.Headers.Action = "RegisterReply"
+			if err := c.SendOneWay(msg); err != nil {
+				t.Error(err)
+			}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	go server.Serve()
+
+	conn, err := network.Dial(server.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := NewIpcClient(conn, IpcClientConfig{
+		ClientId:  "client1",
+		ProcessId: 1234,
+		MessageCallback: func(c Conn, bam *ByteArrayMessage) {
+			msg := &Message{}
+			msg.Headers.RelatesTo = bam.Headers.Id
+			msg.Headers.Actor = MessageActorTypeIpcTestActor2
+			msg.Headers.Action = "PushReply"
+			msg.Body = bam.Body
+			if err := c.SendOneWay(msg); err != nil {
+				t.Error(err)
+			}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	go client.Wait()
+
+	t.Run("client to server", func(t *testing.T) {
+		msg := &Message{}
+		msg.Headers.Actor = MessageActorTypeIpcTestActor1
+		msg.Headers.Action = "Register"
+
+		reply, err := client.RequestReply(context.Background(), msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assert.Equal(t, "RegisterReply", reply.Headers.Action)
+		assert.Equal(t, []string{"client1"}, server.Clients())
+	})
+
+	t.Run("server to client", func(t *testing.T) {
+		msg := &Message{}
+		msg.Headers.Actor = MessageActorTypeIpcTestActor2
+		msg.Headers.Action = "Push"
+		msg.Body = []byte{1, 2, 3}
+
+		reply, err := server.RequestReply(context.Background(), "client1", msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assert.Equal(t, "PushReply", reply.Headers.Action)
+		assert.Equal(t, []byte{1, 2, 3}, reply.Body)
+
+		h, ok := reply.Headers.Ipc()
+		assert.True(t, ok)
+		assert.Equal(t, "client1", h.From)
+	})
+
+	t.Run("unknown client", func(t *testing.T) {
+		err := server.SendOneWay("client2", &Message{})
+		assert.Error(t, err)
+	})
+}
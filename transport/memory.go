@@ -0,0 +1,372 @@
+package transport
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MemoryNetwork is an in-process network, listeners and dialers on the same network
+// are connected by buffered pipes without binding any port.
+// Addresses must be in host:port form so they can be used by lease and federation,
+// port 0 picks an unused port.
+type MemoryNetwork struct {
+	listeners sync.Map
+	nextPort  uint32
+}
+
+func NewMemoryNetwork() *MemoryNetwork {
+	return &MemoryNetwork{
+		nextPort: 10000,
+	}
+}
+
+// memoryListenBacklog is the number of dialed connections waiting for Accept,
+// dial is refused once it is full like a tcp listener with a full accept queue
+const memoryListenBacklog = 128
+
+type memoryAddr string
+
+func (a memoryAddr) Network() string {
+	return "memory"
+}
+
+func (a memoryAddr) String() string {
+	return string(a)
+}
+
+func (n *MemoryNetwork) Listen(addr string) (net.Listener, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if port == "0" {
+		port = strconv.Itoa(int(atomic.AddUint32(&n.nextPort, 1)))
+	}
+
+	l := &memoryListener{
+		parent: n,
+		addr:   memoryAddr(net.JoinHostPort(host, port)),
+		ch:     make(chan net.Conn, memoryListenBacklog),
+		closed: make(chan struct{}),
+	}
+
+	if _, loaded := n.listeners.LoadOrStore(l.addr.String(), l); loaded {
+		return nil, fmt.Errorf("address %v already in use", l.addr)
+	}
+
+	return l, nil
+}
+
+func (n *MemoryNetwork) Dial(addr string) (net.Conn, error) {
+	v, ok := n.listeners.Load(addr)
+	if !ok {
+		return nil, fmt.Errorf("dial %v: connection refused", addr)
+	}
+
+	return v.(*memoryListener).dial()
+}
+
+type memoryListener struct {
+	parent    *MemoryNetwork
+	addr      memoryAddr
+	ch        chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+	nextPort  uint32
+
+	// lock makes the closed check and queueing in dial atomic with the drain in Close
+	lock sync.Mutex
+}
+
+func (l *memoryListener) dial() (net.Conn, error) {
+	remote := memoryAddr(net.JoinHostPort("memory", strconv.Itoa(int(atomic.AddUint32(&l.nextPort, 1)))))
+	c1, c2 := newMemoryConnPair(remote, l.addr)
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if isClosedChan(l.closed) {
+		return nil, fmt.Errorf("dial %v: connection refused", l.addr)
+	}
+
+	select {
+	case l.ch <- c2:
+		return c1, nil
+	default:
+		return nil, fmt.Errorf("dial %v: connection refused, backlog full", l.addr)
+	}
+}
+
+func (l *memoryListener) Accept() (net.Conn, error) {
+	select {
+	case <-l.closed:
+		return nil, net.ErrClosed
+	case c := <-l.ch:
+		return c, nil
+	}
+}
+
+func (l *memoryListener) Close() error {
+	l.closeOnce.Do(func() {
+		l.parent.listeners.Delete(l.addr.String())
+
+		l.lock.Lock()
+		defer l.lock.Unlock()
+
+		close(l.closed)
+
+		// reset connections never accepted
+		for {
+			select {
+			case c := <-l.ch:
+				c.Close()
+			default:
+				return
+			}
+		}
+	})
+
+	return nil
+}
+
+func (l *memoryListener) Addr() net.Addr {
+	return l.addr
+}
+
+// memoryPipe is one direction of a memoryConn, writes never block
+type memoryPipe struct {
+	lock   sync.Mutex
+	buf    bytes.Buffer
+	closed bool
+	notify chan struct{}
+}
+
+func newMemoryPipe() *memoryPipe {
+	return &memoryPipe{
+		notify: make(chan struct{}),
+	}
+}
+
+func (p *memoryPipe) wake() {
+	close(p.notify)
+	p.notify = make(chan struct{})
+}
+
+func (p *memoryPipe) write(b []byte) (int, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.closed {
+		return 0, io.ErrClosedPipe
+	}
+
+	n, err := p.buf.Write(b)
+	p.wake()
+	return n, err
+}
+
+func (p *memoryPipe) close() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if !p.closed {
+		p.closed = true
+		p.wake()
+	}
+}
+
+type memoryConn struct {
+	rx         *memoryPipe
+	tx         *memoryPipe
+	localAddr  net.Addr
+	remoteAddr net.Addr
+
+	readDeadline  pipeDeadline
+	writeDeadline pipeDeadline
+
+	localClosed chan struct{}
+	closeOnce   sync.Once
+}
+
+func newMemoryConnPair(addr1, addr2 net.Addr) (*memoryConn, *memoryConn) {
+	p1 := newMemoryPipe()
+	p2 := newMemoryPipe()
+
+	c1 := &memoryConn{
+		rx:            p1,
+		tx:            p2,
+		localAddr:     addr1,
+		remoteAddr:    addr2,
+		readDeadline:  makePipeDeadline(),
+		writeDeadline: makePipeDeadline(),
+		localClosed:   make(chan struct{}),
+	}
+
+	c2 := &memoryConn{
+		rx:            p2,
+		tx:            p1,
+		localAddr:     addr2,
+		remoteAddr:    addr1,
+		readDeadline:  makePipeDeadline(),
+		writeDeadline: makePipeDeadline(),
+		localClosed:   make(chan struct{}),
+	}
+
+	return c1, c2
+}
+
+func (c *memoryConn) Read(b []byte) (int, error) {
+	for {
+		if isClosedChan(c.localClosed) {
+			return 0, io.ErrClosedPipe
+		}
+
+		if isClosedChan(c.readDeadline.wait()) {
+			return 0, os.ErrDeadlineExceeded
+		}
+
+		c.rx.lock.Lock()
+		if c.rx.buf.Len() > 0 {
+			n, err := c.rx.buf.Read(b)
+			c.rx.lock.Unlock()
+			return n, err
+		}
+
+		if c.rx.closed {
+			c.rx.lock.Unlock()
+			return 0, io.EOF
+		}
+
+		notify := c.rx.notify
+		c.rx.lock.Unlock()
+
+		select {
+		case <-notify:
+		case <-c.localClosed:
+		case <-c.readDeadline.wait():
+		}
+	}
+}
+
+func (c *memoryConn) Write(b []byte) (int, error) {
+	if isClosedChan(c.localClosed) {
+		return 0, io.ErrClosedPipe
+	}
+
+	if isClosedChan(c.writeDeadline.wait()) {
+		return 0, os.ErrDeadlineExceeded
+	}
+
+	return c.tx.write(b)
+}
+
+func (c *memoryConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.localClosed)
+		c.tx.close()
+		c.rx.close()
+	})
+
+	return nil
+}
+
+func (c *memoryConn) LocalAddr() net.Addr {
+	return c.localAddr
+}
+
+func (c *memoryConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func (c *memoryConn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+func (c *memoryConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+func (c *memoryConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
+
+// https://github.com/golang/go/blob/go1.18/src/net/pipe.go#L15
+// pipeDeadline is an abstraction for handling timeouts.
+type pipeDeadline struct {
+	mu     sync.Mutex // Guards timer and cancel
+	timer  *time.Timer
+	cancel chan struct{} // Must be non-nil
+}
+
+func makePipeDeadline() pipeDeadline {
+	return pipeDeadline{cancel: make(chan struct{})}
+}
+
+// set sets the point in time when the deadline will time out.
+// A timeout event is signaled by closing the channel returned by waiter.
+// Once a timeout has occurred, the deadline can be refreshed by specifying a
+// t value in the future.
+//
+// A zero value for t prevents timeout.
+func (d *pipeDeadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel // Wait for the timer callback to finish and close cancel
+	}
+	d.timer = nil
+
+	// Time is zero, then there is no deadline.
+	closed := isClosedChan(d.cancel)
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+
+	// Time in the future, setup a timer to cancel in the future.
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		d.timer = time.AfterFunc(dur, func() {
+			close(d.cancel)
+		})
+		return
+	}
+
+	// Time in the past, so close immediately.
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+// wait returns a channel that is closed when the deadline is exceeded.
+func (d *pipeDeadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cancel
+}
+
+func isClosedChan(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
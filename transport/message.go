@@ -2,6 +2,7 @@ package transport
 
 import (
 	"bytes"
+	"fmt"
 	"io"
 	"sync/atomic"
 
@@ -53,6 +54,13 @@ func writeMessageWithFrame(w io.Writer, message *Message, config frameWriteConfi
 		return err
 	}
 
+	if config.CompressThreshold > 0 && len(msg)-headerLen >= config.CompressThreshold {
+		if z, ok := compressFrameBody(msg, headerLen); ok {
+			msg = z
+			config.SecurityProviderMask |= securityProvider(frameFlagCompressed)
+		}
+	}
+
 	return writeFrame(w, headerLen, msg, config)
 }
 
@@ -68,6 +76,18 @@ func nextMessageHeaderAndBodyFromFrame(r io.Reader, config frameReadConfig) (*Me
 	}
 
 	body := framebody[frameheader.HeaderLength:]
+
+	if frameheader.SecurityProviderMask&frameFlagCompressed != 0 {
+		if !config.Decompress {
+			return nil, nil, fmt.Errorf("unexpected compressed frame")
+		}
+
+		body, err = decompressFrameBody(body)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
 	return headers, body, nil
 }
 
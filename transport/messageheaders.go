@@ -101,6 +101,14 @@ func (h *MessageHeaders) SetCustomHeader(typ MessageHeaderIdType, header interfa
 	return false
 }
 
+func (h *MessageHeaders) ReplaceCustomHeader(typ MessageHeaderIdType, header interface{}) {
+	if h.customHeaders == nil {
+		h.customHeaders = make(map[MessageHeaderIdType][]interface{})
+	}
+
+	h.customHeaders[typ] = []interface{}{header}
+}
+
 func (h *MessageHeaders) AppendCustomHeader(typ MessageHeaderIdType, header ...interface{}) bool {
 	if h.customHeaders == nil {
 		h.customHeaders = make(map[MessageHeaderIdType][]interface{})
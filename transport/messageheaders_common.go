@@ -0,0 +1,311 @@
+package transport
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/tg123/phabrik/common"
+	"github.com/tg123/phabrik/serialization"
+)
+
+func init() {
+	RegisterHeaderActivator(MessageHeaderIdTypeTimeout, func() interface{} {
+		return &TimeoutHeader{}
+	})
+	RegisterHeaderActivator(MessageHeaderIdTypeFabricActivity, func() interface{} {
+		return &FabricActivityHeader{}
+	})
+	RegisterHeaderActivator(MessageHeaderIdTypeRequestInstance, func() interface{} {
+		return &RequestInstanceHeader{}
+	})
+	RegisterHeaderActivator(MessageHeaderIdTypeClientProtocolVersion, func() interface{} {
+		return &ClientProtocolVersionHeader{}
+	})
+	RegisterHeaderActivator(MessageHeaderIdTypeClientIdentity, func() interface{} {
+		return &ClientIdentityHeader{}
+	})
+	RegisterHeaderActivator(MessageHeaderIdTypeClientRole, func() interface{} {
+		return &ClientRoleHeader{}
+	})
+	RegisterHeaderActivator(MessageHeaderIdTypeGatewayRetry, func() interface{} {
+		return &GatewayRetryHeader{}
+	})
+	RegisterHeaderActivator(MessageHeaderIdTypePartitionTarget, func() interface{} {
+		return &PartitionTargetHeader{}
+	})
+	RegisterHeaderActivator(MessageHeaderIdTypeServiceTarget, func() interface{} {
+		return &ServiceTargetHeader{}
+	})
+	RegisterHeaderActivator(MessageHeaderIdTypeQueryAddress, func() interface{} {
+		return &QueryAddressHeader{}
+	})
+}
+
+// FabricActivityId is Common::ActivityId, unlike MessageId its index is 64 bit
+type FabricActivityId struct {
+	Id    serialization.GUID
+	Index uint64
+}
+
+func NewFabricActivityId() (FabricActivityId, error) {
+	g, err := serialization.NewGuidV4()
+	if err != nil {
+		return FabricActivityId{}, err
+	}
+
+	return FabricActivityId{Id: g}, nil
+}
+
+func (a FabricActivityId) IsEmpty() bool {
+	return a.Id.IsEmpty() && a.Index == 0
+}
+
+func (a FabricActivityId) String() string {
+	return fmt.Sprintf("%v:%v", a.Id.String(), a.Index)
+}
+
+type TimeoutHeader struct {
+	Timeout common.TimeSpan
+}
+
+type FabricActivityHeader struct {
+	ActivityId FabricActivityId
+}
+
+type RequestInstanceHeader struct {
+	Instance int64
+}
+
+type ClientProtocolVersionHeader struct {
+	Major int64
+	Minor int64
+}
+
+type ClientIdentityHeader struct {
+	TargetName   string
+	FriendlyName string
+}
+
+type RoleMask int64
+
+const (
+	RoleMaskNone  RoleMask = 0
+	RoleMaskUser  RoleMask = 1
+	RoleMaskAdmin RoleMask = 0xffff
+)
+
+type ClientRoleHeader struct {
+	Role RoleMask
+}
+
+type GatewayRetryHeader struct {
+	ErrorCode FabricErrorCode
+}
+
+type PartitionTargetHeader struct {
+	PartitionId serialization.GUID
+}
+
+type ServiceTargetHeader struct {
+	ServiceName common.Uri
+}
+
+type QueryAddressHeader struct {
+	Address string
+}
+
+func (h *MessageHeaders) Timeout() (time.Duration, bool) {
+	v, ok := h.GetFirstCustomHeader(MessageHeaderIdTypeTimeout)
+	if !ok {
+		return 0, false
+	}
+
+	th, ok := v.(*TimeoutHeader)
+	if !ok {
+		return 0, false
+	}
+
+	return th.Timeout.ToDuration(), true
+}
+
+func (h *MessageHeaders) SetTimeout(timeout time.Duration) {
+	h.ReplaceCustomHeader(MessageHeaderIdTypeTimeout, &TimeoutHeader{
+		Timeout: common.TimeSpanFromDuration(timeout),
+	})
+}
+
+func (h *MessageHeaders) FabricActivity() (FabricActivityId, bool) {
+	v, ok := h.GetFirstCustomHeader(MessageHeaderIdTypeFabricActivity)
+	if !ok {
+		return FabricActivityId{}, false
+	}
+
+	ah, ok := v.(*FabricActivityHeader)
+	if !ok {
+		return FabricActivityId{}, false
+	}
+
+	return ah.ActivityId, true
+}
+
+func (h *MessageHeaders) SetFabricActivity(id FabricActivityId) {
+	h.ReplaceCustomHeader(MessageHeaderIdTypeFabricActivity, &FabricActivityHeader{
+		ActivityId: id,
+	})
+}
+
+func (h *MessageHeaders) RequestInstance() (int64, bool) {
+	v, ok := h.GetFirstCustomHeader(MessageHeaderIdTypeRequestInstance)
+	if !ok {
+		return 0, false
+	}
+
+	rh, ok := v.(*RequestInstanceHeader)
+	if !ok {
+		return 0, false
+	}
+
+	return rh.Instance, true
+}
+
+func (h *MessageHeaders) SetRequestInstance(instance int64) {
+	h.ReplaceCustomHeader(MessageHeaderIdTypeRequestInstance, &RequestInstanceHeader{
+		Instance: instance,
+	})
+}
+
+func (h *MessageHeaders) ClientProtocolVersion() (ClientProtocolVersionHeader, bool) {
+	v, ok := h.GetFirstCustomHeader(MessageHeaderIdTypeClientProtocolVersion)
+	if !ok {
+		return ClientProtocolVersionHeader{}, false
+	}
+
+	vh, ok := v.(*ClientProtocolVersionHeader)
+	if !ok {
+		return ClientProtocolVersionHeader{}, false
+	}
+
+	return *vh, true
+}
+
+func (h *MessageHeaders) SetClientProtocolVersion(version ClientProtocolVersionHeader) {
+	h.ReplaceCustomHeader(MessageHeaderIdTypeClientProtocolVersion, &version)
+}
+
+func (h *MessageHeaders) ClientIdentity() (ClientIdentityHeader, bool) {
+	v, ok := h.GetFirstCustomHeader(MessageHeaderIdTypeClientIdentity)
+	if !ok {
+		return ClientIdentityHeader{}, false
+	}
+
+	ih, ok := v.(*ClientIdentityHeader)
+	if !ok {
+		return ClientIdentityHeader{}, false
+	}
+
+	return *ih, true
+}
+
+func (h *MessageHeaders) SetClientIdentity(identity ClientIdentityHeader) {
+	h.ReplaceCustomHeader(MessageHeaderIdTypeClientIdentity, &identity)
+}
+
+func (h *MessageHeaders) ClientRole() (RoleMask, bool) {
+	v, ok := h.GetFirstCustomHeader(MessageHeaderIdTypeClientRole)
+	if !ok {
+		return RoleMaskNone, false
+	}
+
+	rh, ok := v.(*ClientRoleHeader)
+	if !ok {
+		return RoleMaskNone, false
+	}
+
+	return rh.Role, true
+}
+
+func (h *MessageHeaders) SetClientRole(role RoleMask) {
+	h.ReplaceCustomHeader(MessageHeaderIdTypeClientRole, &ClientRoleHeader{
+		Role: role,
+	})
+}
+
+func (h *MessageHeaders) GatewayRetry() (FabricErrorCode, bool) {
+	v, ok := h.GetFirstCustomHeader(MessageHeaderIdTypeGatewayRetry)
+	if !ok {
+		return FabricErrorCodeSuccess, false
+	}
+
+	rh, ok := v.(*GatewayRetryHeader)
+	if !ok {
+		return FabricErrorCodeSuccess, false
+	}
+
+	return rh.ErrorCode, true
+}
+
+func (h *MessageHeaders) SetGatewayRetry(code FabricErrorCode) {
+	h.ReplaceCustomHeader(MessageHeaderIdTypeGatewayRetry, &GatewayRetryHeader{
+		ErrorCode: code,
+	})
+}
+
+func (h *MessageHeaders) PartitionTarget() (serialization.GUID, bool) {
+	v, ok := h.GetFirstCustomHeader(MessageHeaderIdTypePartitionTarget)
+	if !ok {
+		return serialization.GUID{}, false
+	}
+
+	ph, ok := v.(*PartitionTargetHeader)
+	if !ok {
+		return serialization.GUID{}, false
+	}
+
+	return ph.PartitionId, true
+}
+
+func (h *MessageHeaders) SetPartitionTarget(partitionId serialization.GUID) {
+	h.ReplaceCustomHeader(MessageHeaderIdTypePartitionTarget, &PartitionTargetHeader{
+		PartitionId: partitionId,
+	})
+}
+
+func (h *MessageHeaders) ServiceTarget() (common.Uri, bool) {
+	v, ok := h.GetFirstCustomHeader(MessageHeaderIdTypeServiceTarget)
+	if !ok {
+		return common.Uri{}, false
+	}
+
+	sh, ok := v.(*ServiceTargetHeader)
+	if !ok {
+		return common.Uri{}, false
+	}
+
+	return sh.ServiceName, true
+}
+
+func (h *MessageHeaders) SetServiceTarget(serviceName common.Uri) {
+	h.ReplaceCustomHeader(MessageHeaderIdTypeServiceTarget, &ServiceTargetHeader{
+		ServiceName: serviceName,
+	})
+}
+
+func (h *MessageHeaders) QueryAddress() (string, bool) {
+	v, ok := h.GetFirstCustomHeader(MessageHeaderIdTypeQueryAddress)
+	if !ok {
+		return "", false
+	}
+
+	qh, ok := v.(*QueryAddressHeader)
+	if !ok {
+		return "", false
+	}
+
+	return qh.Address, true
+}
+
+func (h *MessageHeaders) SetQueryAddress(address string) {
+	h.ReplaceCustomHeader(MessageHeaderIdTypeQueryAddress, &QueryAddressHeader{
+		Address: address,
+	})
+}
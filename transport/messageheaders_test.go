@@ -6,17 +6,13 @@ import (
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/tg123/phabrik/common"
 	"github.com/tg123/phabrik/serialization"
 )
 
 func TestMessageHeadersSerialization(t *testing.T) {
 	var buf bytes.Buffer
 
-	type timeoutHeader struct {
-		Timeout time.Duration
-	}
-	RegisterHeaderActivator(MessageHeaderIdTypeTimeout, func() interface{} { return &timeoutHeader{} })
-
 	var h MessageHeaders
 	h.Action = "AC"
 	h.Actor = MessageActorTypeGenericTestActor2
@@ -28,8 +24,8 @@ func TestMessageHeadersSerialization(t *testing.T) {
 	h.Idempotent = true
 	h.RelatesTo = MessageId{serialization.MustNewGuidV4(), 200}
 	h.RetryCount = 4567
-	h.SetCustomHeader(MessageHeaderIdTypeTimeout, &timeoutHeader{
-		Timeout: 20 * time.Second,
+	h.SetCustomHeader(MessageHeaderIdTypeTimeout, &TimeoutHeader{
+		Timeout: common.TimeSpanFromDuration(20 * time.Second),
 	})
 
 	err := h.writeTo(&buf)
@@ -48,7 +44,7 @@ func TestMessageHeadersSerialization(t *testing.T) {
 	{
 		th, ok := h2.GetFirstCustomHeader(MessageHeaderIdTypeTimeout)
 		assert.True(t, ok)
-		assert.Equal(t, &timeoutHeader{Timeout: 20 * time.Second}, th)
+		assert.Equal(t, &TimeoutHeader{Timeout: common.TimeSpanFromDuration(20 * time.Second)}, th)
 	}
 
 	{
@@ -58,3 +54,108 @@ func TestMessageHeadersSerialization(t *testing.T) {
 
 	}
 }
+
+func TestTypedMessageHeaders(t *testing.T) {
+	var buf bytes.Buffer
+
+	activityId, err := NewFabricActivityId()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	partitionId := serialization.MustNewGuidV4()
+
+	var h MessageHeaders
+	h.Id = MessageId{serialization.MustNewGuidV4(), 1}
+	h.SetTimeout(5 * time.Second)
+	h.SetFabricActivity(activityId)
+	h.SetRequestInstance(42)
+	h.SetClientProtocolVersion(ClientProtocolVersionHeader{Major: 1, Minor: 2})
+	h.SetClientIdentity(ClientIdentityHeader{TargetName: "target", FriendlyName: "friendly"})
+	h.SetClientRole(RoleMaskAdmin)
+	h.SetGatewayRetry(FabricErrorCode(7))
+	h.SetPartitionTarget(partitionId)
+	h.SetServiceTarget(common.Uri{Type: common.UriTypeAbsolute, Scheme: "fabric", Path: "/app/svc", PathSegments: []string{"app", "svc"}})
+	h.SetQueryAddress("/")
+
+	// setter replaces existing value
+	h.SetTimeout(10 * time.Second)
+
+	if err := h.writeTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	h2, err := parseFabricMessageHeaders(bytes.NewBuffer(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, h, *h2)
+
+	{
+		v, ok := h2.Timeout()
+		assert.True(t, ok)
+		assert.Equal(t, 10*time.Second, v)
+	}
+
+	{
+		v, ok := h2.FabricActivity()
+		assert.True(t, ok)
+		assert.Equal(t, activityId, v)
+	}
+
+	{
+		v, ok := h2.RequestInstance()
+		assert.True(t, ok)
+		assert.Equal(t, int64(42), v)
+	}
+
+	{
+		v, ok := h2.ClientProtocolVersion()
+		assert.True(t, ok)
+		assert.Equal(t, ClientProtocolVersionHeader{Major: 1, Minor: 2}, v)
+	}
+
+	{
+		v, ok := h2.ClientIdentity()
+		assert.True(t, ok)
+		assert.Equal(t, ClientIdentityHeader{TargetName: "target", FriendlyName: "friendly"}, v)
+	}
+
+	{
+		v, ok := h2.ClientRole()
+		assert.True(t, ok)
+		assert.Equal(t, RoleMaskAdmin, v)
+	}
+
+	{
+		v, ok := h2.GatewayRetry()
+		assert.True(t, ok)
+		assert.Equal(t, FabricErrorCode(7), v)
+	}
+
+	{
+		v, ok := h2.PartitionTarget()
+		assert.True(t, ok)
+		assert.Equal(t, partitionId, v)
+	}
+
+	{
+		v, ok := h2.ServiceTarget()
+		assert.True(t, ok)
+		assert.Equal(t, "/app/svc", v.Path)
+		assert.Equal(t, []string{"app", "svc"}, v.PathSegments)
+	}
+
+	{
+		v, ok := h2.QueryAddress()
+		assert.True(t, ok)
+		assert.Equal(t, "/", v)
+	}
+
+	{
+		var empty MessageHeaders
+		_, ok := empty.Timeout()
+		assert.False(t, ok)
+	}
+}
@@ -0,0 +1,96 @@
+package transport
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// ConnInfo identifies the connection an Observer event comes from
+type ConnInfo struct {
+	LocalAddr  net.Addr
+	RemoteAddr net.Addr
+}
+
+// RequestTrace describes a finished RequestReply
+type RequestTrace struct {
+	Actor      MessageActorType
+	Action     string
+	ActivityId FabricActivityId
+	Start      time.Time
+	Latency    time.Duration
+	// ErrorCode is from the reply header or mapped from Err by ErrorCodeOf
+	ErrorCode FabricErrorCode
+	Err       error
+}
+
+// Observer receives metrics and traces of a connection, it is called inline and must not block.
+// Embed NopObserver to implement part of it.
+type Observer interface {
+	FrameSent(conn ConnInfo, bytes int)
+	FrameReceived(conn ConnInfo, bytes int)
+	CRCFailure(conn ConnInfo, err error)
+	RequestCompleted(conn ConnInfo, trace RequestTrace)
+	PendingRequests(conn ConnInfo, pending int64)
+	HeartbeatRTT(conn ConnInfo, rtt time.Duration)
+}
+
+type NopObserver struct{}
+
+var _ Observer = NopObserver{}
+
+func (NopObserver) FrameSent(ConnInfo, int)                 {}
+func (NopObserver) FrameReceived(ConnInfo, int)             {}
+func (NopObserver) CRCFailure(ConnInfo, error)              {}
+func (NopObserver) RequestCompleted(ConnInfo, RequestTrace) {}
+func (NopObserver) PendingRequests(ConnInfo, int64)         {}
+func (NopObserver) HeartbeatRTT(ConnInfo, time.Duration)    {}
+
+// ConnectionStats are counters of a connection since it is created
+type ConnectionStats struct {
+	BytesSent      uint64
+	BytesReceived  uint64
+	FramesSent     uint64
+	FramesReceived uint64
+	CRCFailures    uint64
+}
+
+type connectionCounters struct {
+	bytesSent      uint64
+	bytesReceived  uint64
+	framesSent     uint64
+	framesReceived uint64
+	crcFailures    uint64
+}
+
+func (c *connectionCounters) stats() ConnectionStats {
+	return ConnectionStats{
+		BytesSent:      atomic.LoadUint64(&c.bytesSent),
+		BytesReceived:  atomic.LoadUint64(&c.bytesReceived),
+		FramesSent:     atomic.LoadUint64(&c.framesSent),
+		FramesReceived: atomic.LoadUint64(&c.framesReceived),
+		CRCFailures:    atomic.LoadUint64(&c.crcFailures),
+	}
+}
+
+type countingWriter struct {
+	w net.Conn
+	n int
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	w.n += n
+	return n, err
+}
+
+type countingReader struct {
+	r net.Conn
+	n int
+}
+
+func (r *countingReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.n += n
+	return n, err
+}
@@ -0,0 +1,174 @@
+package transport
+
+import (
+	"context"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingObserver struct {
+	NopObserver
+
+	lock           sync.Mutex
+	framesSent     int
+	framesReceived int
+	crcFailures    int
+	requests       []RequestTrace
+	maxPending     int64
+	rtts           []time.Duration
+}
+
+func (o *recordingObserver) FrameSent(ConnInfo, int) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.framesSent++
+}
+
+func (o *recordingObserver) FrameReceived(ConnInfo, int) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.framesReceived++
+}
+
+func (o *recordingObserver) CRCFailure(ConnInfo, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.crcFailures++
+}
+
+func (o *recordingObserver) RequestCompleted(_ ConnInfo, trace RequestTrace) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.requests = append(o.requests, trace)
+}
+
+func (o *recordingObserver) PendingRequests(_ ConnInfo, pending int64) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if pending > o.maxPending {
+		o.maxPending = pending
+	}
+}
+
+func (o *recordingObserver) HeartbeatRTT(_ ConnInfo, rtt time.Duration) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.rtts = append(o.rtts, rtt)
+}
+
+func TestObserver(t *testing.T) {
+	serverObserver := &recordingObserver{}
+	activities := make(chan FabricActivityId, 1)
+
+	network := NewMemoryNetwork()
+	server, err := ListenMemory(network, "observer:0", ServerConfig{
+		Config: Config{
+			Observer: serverObserver,
+		},
+		MessageCallback: func(c Conn, bam *ByteArrayMessage) {
+			a, _ := bam.Headers.FabricActivity()
+			activities <- a
+
+			msg := &Message{}
+			msg.Headers.RelatesTo = bam.Headers.Id
+			if err := c.SendOneWay(msg); err != nil {
+				t.Error(err)
+			}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	go server.Serve()
+
+	clientObserver := &recordingObserver{}
+	client, err := DialMemory(network, server.Addr().String(), ClientConfig{
+		Config: Config{
+			Observer: clientObserver,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	go client.Wait()
+
+	activityId, err := NewFabricActivityId()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(ContextWithActivity(context.Background(), activityId), time.Second)
+	defer cancel()
+
+	msg := &Message{}
+	msg.Headers.Actor = MessageActorTypeGenericTestActor
+	msg.Headers.Action = "Observe"
+
+	if _, err := client.RequestReply(ctx, msg); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, activityId, <-activities)
+
+	if _, err := client.Ping(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	clientObserver.lock.Lock()
+	assert.Len(t, clientObserver.requests, 1)
+	trace := clientObserver.requests[0]
+	assert.Equal(t, MessageActorTypeGenericTestActor, trace.Actor)
+	assert.Equal(t, "Observe", trace.Action)
+	assert.Equal(t, activityId, trace.ActivityId)
+	assert.Equal(t, FabricErrorCodeSuccess, trace.ErrorCode)
+	assert.True(t, trace.Latency > 0)
+	assert.Equal(t, int64(1), clientObserver.maxPending)
+	assert.Len(t, clientObserver.rtts, 1)
+	assert.True(t, clientObserver.framesSent >= 3) // init, request and heartbeat
+	clientObserver.lock.Unlock()
+
+	stats := client.Stats()
+	assert.True(t, stats.FramesSent >= 3)
+	assert.True(t, stats.FramesReceived >= 2)
+	assert.True(t, stats.BytesSent > 0)
+	assert.True(t, stats.BytesReceived > 0)
+	assert.Equal(t, int64(0), client.RequestTableStats().Pending)
+
+	t.Run("crc failure", func(t *testing.T) {
+		c, err := DialMemory(network, server.Addr().String(), ClientConfig{
+			Config: Config{
+				DisableGenerateFrameHeaderCRC: true,
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+
+		assert.Error(t, c.Wait())
+
+		serverObserver.lock.Lock()
+		defer serverObserver.lock.Unlock()
+		assert.Equal(t, 1, serverObserver.crcFailures)
+	})
+}
+
+func TestActivityTraceId(t *testing.T) {
+	activityId, err := NewFabricActivityId()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	traceId := activityId.TraceId()
+	assert.Equal(t, strings.ReplaceAll(activityId.Id.String(), "-", ""), hex.EncodeToString(traceId[:]))
+
+	_, ok := ActivityFromContext(context.Background())
+	assert.False(t, ok)
+}
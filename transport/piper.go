@@ -1,10 +1,10 @@
 package transport
 
 import (
-	"bytes"
 	"fmt"
-	"log"
 	"net"
+
+	"github.com/tg123/phabrik/common"
 )
 
 type PiperConfig struct {
@@ -16,6 +16,7 @@ type PiperConfig struct {
 type Piper struct {
 	listener net.Listener
 	config   PiperConfig
+	logger   common.Logger
 }
 
 type MessageTransformer func(src, dst net.Conn, msg *ByteArrayMessage) *Message
@@ -29,6 +30,7 @@ func NewPiper(l net.Listener, config PiperConfig) (*Piper, error) {
 	return &Piper{
 		listener: l,
 		config:   config,
+		logger:   common.LoggerOrDefault(config.Logger),
 	}, nil
 }
 
@@ -77,7 +79,7 @@ func (p *Piper) Serve() error {
 		c, err := p.listener.Accept()
 		if err != nil {
 			if neterr, ok := err.(net.Error); ok && neterr.Temporary() {
-				log.Printf("accepting error %v", err)
+				p.logger.Warn("accepting error", common.LogKeyError, err)
 				continue
 			}
 
@@ -86,7 +88,7 @@ func (p *Piper) Serve() error {
 
 		go func() {
 			if err := p.handle(c); err != nil {
-				log.Printf("pipe err %v", err)
+				p.logger.Debug("pipe err", common.LogKeyConn, c.RemoteAddr(), common.LogKeyError, err)
 			}
 		}()
 	}
@@ -110,18 +112,15 @@ func (p *Piper) pipe(src, dst *connection) error {
 
 func (p *Piper) copy(src, dst *connection) error {
 	for {
-		frameheader, framebody, err := nextFrame(src.conn, src.frameRCfg)
-		if err != nil {
-			return err
-		}
+		// peers may negotiate compression through the piper, forward decompressed
+		rcfg := src.frameRCfg
+		rcfg.Decompress = true
 
-		headers, err := parseFabricMessageHeaders(bytes.NewBuffer(framebody[:frameheader.HeaderLength]))
+		headers, body, err := nextMessageHeaderAndBodyFromFrame(src.conn, rcfg)
 		if err != nil {
 			return err
 		}
 
-		body := framebody[frameheader.HeaderLength:]
-
 		msg := &ByteArrayMessage{
 			Headers: *headers,
 			Body:    body,
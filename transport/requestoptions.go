@@ -0,0 +1,151 @@
+package transport
+
+import (
+	"context"
+	"time"
+)
+
+// RetryClassifier decides if a failed request can be sent again
+type RetryClassifier func(code FabricErrorCode) bool
+
+// IsRetryableErrorCode returns true for transient errors, such as timeout or a replica not ready yet
+func IsRetryableErrorCode(code FabricErrorCode) bool {
+	switch code {
+	case FabricErrorCodeTimeout,
+		FabricErrorCodeCommunicationError,
+		FabricErrorCodeNotPrimary,
+		FabricErrorCodeNotReady,
+		FabricErrorCodeReconfigurationPending,
+		FabricErrorCodeServiceOffline:
+		return true
+	}
+
+	return false
+}
+
+// RequestOptions controls RequestReplyWithOptions, the zero value sends the request once and waits until ctx is done
+type RequestOptions struct {
+	// Timeout of each attempt, also sent to the remote side in the Timeout header
+	Timeout time.Duration
+
+	// RetryCount is the max number of resends, only messages with Idempotent header are resent
+	RetryCount int
+
+	// RetryBackoff is the delay before the first resend, doubled on each resend up to MaxRetryBackoff
+	RetryBackoff    time.Duration
+	MaxRetryBackoff time.Duration
+
+	// IsRetryable classifies errors and reply error codes, IsRetryableErrorCode is used if nil
+	IsRetryable RetryClassifier
+}
+
+func (o *RequestOptions) isRetryable(code FabricErrorCode) bool {
+	if o.IsRetryable != nil {
+		return o.IsRetryable(code)
+	}
+
+	return IsRetryableErrorCode(code)
+}
+
+func (o *RequestOptions) backoff(retry int) time.Duration {
+	d := o.RetryBackoff
+	for i := 1; i < retry && d > 0; i++ {
+		d *= 2
+		if o.MaxRetryBackoff > 0 && d >= o.MaxRetryBackoff {
+			break
+		}
+	}
+
+	if o.MaxRetryBackoff > 0 && d > o.MaxRetryBackoff {
+		d = o.MaxRetryBackoff
+	}
+
+	return d
+}
+
+// doner is implemented by conns which can be closed for good, such as *Client
+type doner interface {
+	Done() <-chan struct{}
+}
+
+func isDone(conn Conn) bool {
+	d, ok := conn.(doner)
+	if !ok {
+		return false
+	}
+
+	select {
+	case <-d.Done():
+		return true
+	default:
+		return false
+	}
+}
+
+// RequestReplyWithOptions sends a request over conn, resending idempotent messages on retryable errors.
+// Each resend gets a new message id and an increased RetryCount header.
+// A reply with an error code is returned as is once no more retry is allowed.
+// No resend is made once conn is closed, a ClientPool keeps retrying over its other connections.
+func RequestReplyWithOptions(ctx context.Context, conn Conn, message *Message, opts RequestOptions) (*ByteArrayMessage, error) {
+	for retry := 0; ; retry++ {
+		if retry > 0 {
+			if err := sleepContext(ctx, opts.backoff(retry)); err != nil {
+				return nil, err
+			}
+
+			message.Headers.Id = MessageId{}
+			message.Headers.RetryCount++
+		}
+
+		reply, err := requestReplyOnce(ctx, conn, message, opts.Timeout)
+
+		code := ErrorCodeOf(err)
+		if err == nil {
+			code = reply.Headers.ErrorCode
+		}
+
+		if code == FabricErrorCodeSuccess ||
+			!message.Headers.Idempotent ||
+			retry >= opts.RetryCount ||
+			ctx.Err() != nil ||
+			isDone(conn) ||
+			!opts.isRetryable(code) {
+			return reply, err
+		}
+	}
+}
+
+func requestReplyOnce(ctx context.Context, conn Conn, message *Message, timeout time.Duration) (*ByteArrayMessage, error) {
+	if timeout <= 0 {
+		return conn.RequestReply(ctx, message)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		message.Headers.SetTimeout(time.Until(deadline))
+	}
+
+	return conn.RequestReply(ctx, message)
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+func (c *connection) RequestReplyWithOptions(ctx context.Context, message *Message, opts RequestOptions) (*ByteArrayMessage, error) {
+	return RequestReplyWithOptions(ctx, c, message, opts)
+}
@@ -0,0 +1,177 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestReplyWithOptions(t *testing.T) {
+	var lock sync.Mutex
+	var received []MessageHeaders
+	failures := 0
+
+	network := NewMemoryNetwork()
+	server, err := ListenMemory(network, "retry:0", ServerConfig{
+		MessageCallback: func(c Conn, bam *ByteArrayMessage) {
+			lock.Lock()
+			received = append(received, bam.Headers)
+			fail := failures > 0
+			if fail {
+				failures--
+			}
+			lock.Unlock()
+
+			if bam.Headers.Action == "drop" && fail {
+				return
+			}
+
+			msg := &Message{}
+			msg.Headers.RelatesTo = bam.Headers.Id
+			if fail {
+				msg.Headers.ErrorCode = FabricErrorCodeNotReady
+			}
+
+			if err := c.SendOneWay(msg); err != nil {
+				t.Error(err)
+			}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	go server.Serve()
+
+	client, err := DialMemory(network, server.Addr().String(), ClientConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	go client.Wait()
+
+	opts := RequestOptions{
+		Timeout:      200 * time.Millisecond,
+		RetryCount:   3,
+		RetryBackoff: time.Millisecond,
+	}
+
+	reset := func(n int) {
+		lock.Lock()
+		defer lock.Unlock()
+		failures = n
+		received = nil
+	}
+
+	t.Run("retry idempotent", func(t *testing.T) {
+		reset(2)
+
+		msg := &Message{}
+		msg.Headers.Idempotent = true
+
+		reply, err := client.RequestReplyWithOptions(context.Background(), msg, opts)
+		assert.NoError(t, err)
+		assert.Equal(t, FabricErrorCodeSuccess, reply.Headers.ErrorCode)
+
+		lock.Lock()
+		defer lock.Unlock()
+
+		assert.Len(t, received, 3)
+		for i, h := range received {
+			assert.Equal(t, int32(i), h.RetryCount)
+
+			timeout, ok := h.Timeout()
+			assert.True(t, ok)
+			assert.True(t, timeout > 0 && timeout <= opts.Timeout)
+		}
+
+		assert.NotEqual(t, received[0].Id, received[1].Id)
+	})
+
+	t.Run("retry exhausted", func(t *testing.T) {
+		reset(10)
+
+		msg := &Message{}
+		msg.Headers.Idempotent = true
+
+		reply, err := client.RequestReplyWithOptions(context.Background(), msg, opts)
+		assert.NoError(t, err)
+		assert.Equal(t, FabricErrorCodeNotReady, reply.Headers.ErrorCode)
+
+		lock.Lock()
+		defer lock.Unlock()
+		assert.Len(t, received, opts.RetryCount+1)
+	})
+
+	t.Run("not idempotent", func(t *testing.T) {
+		reset(1)
+
+		reply, err := client.RequestReplyWithOptions(context.Background(), &Message{}, opts)
+		assert.NoError(t, err)
+		assert.Equal(t, FabricErrorCodeNotReady, reply.Headers.ErrorCode)
+
+		lock.Lock()
+		defer lock.Unlock()
+		assert.Len(t, received, 1)
+	})
+
+	t.Run("retry timeout", func(t *testing.T) {
+		reset(1)
+
+		msg := &Message{}
+		msg.Headers.Action = "drop"
+		msg.Headers.Idempotent = true
+
+		reply, err := client.RequestReplyWithOptions(context.Background(), msg, opts)
+		assert.NoError(t, err)
+		assert.Equal(t, FabricErrorCodeSuccess, reply.Headers.ErrorCode)
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		reset(1)
+
+		msg := &Message{}
+		msg.Headers.Action = "drop"
+
+		_, err := client.RequestReplyWithOptions(context.Background(), msg, opts)
+		assert.True(t, errors.Is(err, context.DeadlineExceeded))
+		assert.Equal(t, FabricErrorCodeTimeout, ErrorCodeOf(err))
+	})
+
+	t.Run("closed connection", func(t *testing.T) {
+		closed, err := DialMemory(network, server.Addr().String(), ClientConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		go closed.Wait()
+		closed.Close()
+
+		msg := &Message{}
+		msg.Headers.Idempotent = true
+
+		opts := opts
+		opts.RetryBackoff = time.Second
+
+		start := time.Now()
+		_, err = closed.RequestReplyWithOptions(context.Background(), msg, opts)
+		assert.Error(t, err)
+		assert.Less(t, time.Since(start), opts.RetryBackoff)
+	})
+}
+
+func TestRequestOptionsBackoff(t *testing.T) {
+	opts := RequestOptions{
+		RetryBackoff:    10 * time.Millisecond,
+		MaxRetryBackoff: 50 * time.Millisecond,
+	}
+
+	assert.Equal(t, 10*time.Millisecond, opts.backoff(1))
+	assert.Equal(t, 20*time.Millisecond, opts.backoff(2))
+	assert.Equal(t, 40*time.Millisecond, opts.backoff(3))
+	assert.Equal(t, 50*time.Millisecond, opts.backoff(4))
+	assert.Equal(t, 50*time.Millisecond, opts.backoff(100))
+}
@@ -2,32 +2,80 @@ package transport
 
 import (
 	"context"
-	"fmt"
 	"sync"
+	"sync/atomic"
 )
 
+func init() {
+	RegisterHeaderActivator(MessageHeaderIdTypeUncorrelatedReply, func() interface{} {
+		return &UncorrelatedReplyHeader{}
+	})
+}
+
+// UncorrelatedReplyHeader marks a reply which is not expected to match a pending request
+type UncorrelatedReplyHeader struct {
+}
+
+// requestTableHistory is the number of finished request ids kept to tell late or duplicate replies from orphaned ones
+const requestTableHistory = 4096
+
+type requestState int
+
+const (
+	requestStateReplied requestState = iota
+	requestStateAbandoned
+)
+
+// RequestTable correlates replies to pending requests by RelatesTo header, the zero value is ready to use.
+// Replies to requests which are already finished are swallowed and counted as late or duplicate,
+// replies matching no known request are orphaned and passed to UncorrelatedReplyCallback, or counted and dropped if nil.
 type RequestTable struct {
 	table sync.Map
+
+	// UncorrelatedReplyCallback receives orphaned replies and messages with UncorrelatedReplyHeader,
+	// orphaned replies are dropped and Feed returns false for UncorrelatedReplyHeader if nil
+	UncorrelatedReplyCallback func(*ByteArrayMessage)
+
+	historyLock sync.Mutex
+	history     map[MessageId]requestState
+	historyRing []MessageId
+	historyNext int
+
+	pending      int64
+	late         uint64
+	duplicate    uint64
+	orphaned     uint64
+	uncorrelated uint64
+}
+
+type RequestTableStats struct {
+	Pending      int64
+	Late         uint64
+	Duplicate    uint64
+	Orphaned     uint64
+	Uncorrelated uint64
 }
 
 type PendingRequest struct {
 	parent *RequestTable
 	id     MessageId
 	ch     chan *ByteArrayMessage
-	close  sync.Once
+	err    error
 }
 
 func (r *PendingRequest) Close() error {
-	pr, ok := r.parent.table.LoadAndDelete(r.id)
+	return r.closeWithError(ErrOperationCancelled)
+}
+
+func (r *PendingRequest) closeWithError(err error) error {
+	pr, ok := r.parent.remove(r.id, requestStateAbandoned)
 	if !ok {
 		return nil
 	}
 
-	pr.(*PendingRequest).close.Do(func() {
-		ch := pr.(*PendingRequest).ch
-		close(ch)
-	})
-
+	// written before close, read by Wait after the channel is closed
+	pr.err = err
+	close(pr.ch)
 	return nil
 }
 
@@ -35,18 +83,30 @@ func (r *PendingRequest) Wait(ctx context.Context) (*ByteArrayMessage, error) {
 	defer r.Close()
 	select {
 	case <-ctx.Done():
+		r.Close()
+
+		// reply may arrive along with ctx done
+		if reply, ok := <-r.ch; ok && reply != nil {
+			return reply, nil
+		}
+
 		return nil, ctx.Err()
 	case reply := <-r.ch:
 		if reply == nil {
-			return nil, fmt.Errorf("operation cancelled")
+			return nil, r.err
 		}
 		return reply, nil
 	}
 }
 
 func (r *RequestTable) Close() error {
+	return r.CloseWithError(ErrOperationCancelled)
+}
+
+// CloseWithError fails all pending requests with err
+func (r *RequestTable) CloseWithError(err error) error {
 	r.table.Range(func(key, value interface{}) bool {
-		value.(*PendingRequest).Close()
+		value.(*PendingRequest).closeWithError(err)
 		return true
 	})
 
@@ -59,22 +119,115 @@ func (r *RequestTable) Put(msg *Message) *PendingRequest {
 	p := &PendingRequest{
 		parent: r,
 		id:     id,
-		ch:     make(chan *ByteArrayMessage),
+		ch:     make(chan *ByteArrayMessage, 1),
 	}
-	r.table.Store(id, p)
+
+	// ids are unique, an existing entry is only replaced without counting
+	if _, loaded := r.table.LoadOrStore(id, p); loaded {
+		r.table.Store(id, p)
+	} else {
+		atomic.AddInt64(&r.pending, 1)
+	}
+
 	return p
 }
 
+// remove takes a pending request out of the table, only one of reply and close wins
+func (r *RequestTable) remove(id MessageId, state requestState) (*PendingRequest, bool) {
+	pr, ok := r.table.LoadAndDelete(id)
+	if !ok {
+		return nil, false
+	}
+
+	atomic.AddInt64(&r.pending, -1)
+	r.remember(id, state)
+	return pr.(*PendingRequest), true
+}
+
+func (r *RequestTable) remember(id MessageId, state requestState) {
+	r.historyLock.Lock()
+	defer r.historyLock.Unlock()
+
+	if r.history == nil {
+		r.history = make(map[MessageId]requestState)
+		r.historyRing = make([]MessageId, requestTableHistory)
+	}
+
+	if _, ok := r.history[id]; !ok {
+		old := r.historyRing[r.historyNext]
+		if !old.IsEmpty() {
+			delete(r.history, old)
+		}
+
+		r.historyRing[r.historyNext] = id
+		r.historyNext = (r.historyNext + 1) % len(r.historyRing)
+	}
+
+	r.history[id] = state
+}
+
+// finished returns the state of a finished request and marks it replied
+func (r *RequestTable) finished(id MessageId) (requestState, bool) {
+	r.historyLock.Lock()
+	defer r.historyLock.Unlock()
+
+	state, ok := r.history[id]
+	if ok {
+		r.history[id] = requestStateReplied
+	}
+
+	return state, ok
+}
+
+// Feed delivers a reply to its pending request, it never blocks.
+// It returns false if the message is not a reply, or has UncorrelatedReplyHeader without UncorrelatedReplyCallback.
 func (r *RequestTable) Feed(msg *ByteArrayMessage) bool {
+	if _, ok := msg.Headers.GetFirstCustomHeader(MessageHeaderIdTypeUncorrelatedReply); ok {
+		atomic.AddUint64(&r.uncorrelated, 1)
+		return r.uncorrelatedReply(msg)
+	}
+
 	id := msg.Headers.RelatesTo
-	if !id.IsEmpty() {
-		pr, ok := r.table.LoadAndDelete(id)
+	if id.IsEmpty() {
+		return false
+	}
+
+	if pr, ok := r.remove(id, requestStateReplied); ok {
+		// buffered and the only send on this channel
+		pr.ch <- msg
+		return true
+	}
 
-		if ok {
-			pr.(*PendingRequest).ch <- msg
-			return true
+	if state, ok := r.finished(id); ok {
+		if state == requestStateAbandoned {
+			atomic.AddUint64(&r.late, 1)
+		} else {
+			atomic.AddUint64(&r.duplicate, 1)
 		}
+
+		return true
 	}
 
-	return false
+	atomic.AddUint64(&r.orphaned, 1)
+	r.uncorrelatedReply(msg)
+	return true
+}
+
+func (r *RequestTable) uncorrelatedReply(msg *ByteArrayMessage) bool {
+	if r.UncorrelatedReplyCallback == nil {
+		return false
+	}
+
+	r.UncorrelatedReplyCallback(msg)
+	return true
+}
+
+func (r *RequestTable) Stats() RequestTableStats {
+	return RequestTableStats{
+		Pending:      atomic.LoadInt64(&r.pending),
+		Late:         atomic.LoadUint64(&r.late),
+		Duplicate:    atomic.LoadUint64(&r.duplicate),
+		Orphaned:     atomic.LoadUint64(&r.orphaned),
+		Uncorrelated: atomic.LoadUint64(&r.uncorrelated),
+	}
 }
@@ -0,0 +1,100 @@
+package transport
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestTable(t *testing.T) {
+	f, err := newMessageFactory()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reply := func(id MessageId) *ByteArrayMessage {
+		msg := &ByteArrayMessage{}
+		msg.Headers.RelatesTo = id
+		return msg
+	}
+
+	var table RequestTable
+	var uncorrelated []*ByteArrayMessage
+	table.UncorrelatedReplyCallback = func(msg *ByteArrayMessage) {
+		uncorrelated = append(uncorrelated, msg)
+	}
+
+	t.Run("reply before wait", func(t *testing.T) {
+		msg := f.newMessage()
+		pr := table.Put(msg)
+		assert.Equal(t, int64(1), table.Stats().Pending)
+
+		// must not block without a waiter
+		assert.True(t, table.Feed(reply(msg.Headers.Id)))
+
+		r, err := pr.Wait(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, msg.Headers.Id, r.Headers.RelatesTo)
+
+		assert.True(t, table.Feed(reply(msg.Headers.Id)))
+		assert.Equal(t, uint64(1), table.Stats().Duplicate)
+	})
+
+	t.Run("late reply", func(t *testing.T) {
+		msg := f.newMessage()
+		pr := table.Put(msg)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+
+		_, err := pr.Wait(ctx)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+		assert.True(t, table.Feed(reply(msg.Headers.Id)))
+		assert.True(t, table.Feed(reply(msg.Headers.Id)))
+
+		stats := table.Stats()
+		assert.Equal(t, uint64(1), stats.Late)
+		assert.Equal(t, uint64(2), stats.Duplicate)
+		assert.Equal(t, int64(0), stats.Pending)
+	})
+
+	t.Run("orphaned", func(t *testing.T) {
+		assert.True(t, table.Feed(reply(f.Next())))
+		assert.Equal(t, uint64(1), table.Stats().Orphaned)
+		assert.Len(t, uncorrelated, 1)
+
+		// not a reply
+		assert.False(t, table.Feed(&ByteArrayMessage{}))
+	})
+
+	t.Run("uncorrelated header", func(t *testing.T) {
+		msg := &ByteArrayMessage{}
+		msg.Headers.AppendCustomHeader(MessageHeaderIdTypeUncorrelatedReply, &UncorrelatedReplyHeader{})
+
+		assert.True(t, table.Feed(msg))
+		assert.Equal(t, uint64(1), table.Stats().Uncorrelated)
+		assert.Len(t, uncorrelated, 2)
+	})
+
+	t.Run("close", func(t *testing.T) {
+		pr := table.Put(f.newMessage())
+		table.Close()
+
+		_, err := pr.Wait(context.Background())
+		assert.Error(t, err)
+		assert.Equal(t, int64(0), table.Stats().Pending)
+	})
+
+	t.Run("without callback", func(t *testing.T) {
+		var table RequestTable
+		assert.True(t, table.Feed(reply(f.Next())))
+		assert.Equal(t, uint64(1), table.Stats().Orphaned)
+
+		msg := &ByteArrayMessage{}
+		msg.Headers.AppendCustomHeader(MessageHeaderIdTypeUncorrelatedReply, &UncorrelatedReplyHeader{})
+		assert.False(t, table.Feed(msg))
+	})
+}
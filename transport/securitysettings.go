@@ -0,0 +1,283 @@
+package transport
+
+import (
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/pkcs12"
+)
+
+// X509Name accepts a remote certificate by its subject common name,
+// when IssuerThumbprints is not empty the certificate must be issued by one of them
+type X509Name struct {
+	CommonName        string
+	IssuerThumbprints []string
+}
+
+// SecuritySettings is the X509 part of Fabric's Transport::SecuritySettings
+type SecuritySettings struct {
+	// Certificate is presented to the remote side
+	Certificate *tls.Certificate
+
+	// RemoteCertThumbprints are SHA1 thumbprints of accepted remote certificates,
+	// put both primary and secondary thumbprints here during rollover
+	RemoteCertThumbprints []string
+
+	// RemoteNames are accepted remote common names
+	RemoteNames []X509Name
+
+	// RootCAs verifies chains of RemoteNames without issuer pinning, system roots are used if nil
+	RootCAs *x509.CertPool
+
+	// AdminClientCertThumbprints and AdminClientNames are also accepted remote certificates,
+	// clients using them get RoleMaskAdmin from Authorizer, other clients get RoleMaskUser
+	AdminClientCertThumbprints []string
+	AdminClientNames           []X509Name
+}
+
+// CertThumbprint returns SHA1 thumbprint of a certificate in lower case hex
+func CertThumbprint(cert *x509.Certificate) string {
+	s := sha1.Sum(cert.Raw)
+	return hex.EncodeToString(s[:])
+}
+
+func normalizeThumbprint(thumbprint string) string {
+	return strings.ToLower(strings.Join(strings.Fields(thumbprint), ""))
+}
+
+func containsThumbprint(thumbprints []string, thumbprint string) bool {
+	for _, t := range thumbprints {
+		if normalizeThumbprint(t) == thumbprint {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *SecuritySettings) hasRemoteRules() bool {
+	return len(s.RemoteCertThumbprints) > 0 || len(s.RemoteNames) > 0 ||
+		len(s.AdminClientCertThumbprints) > 0 || len(s.AdminClientNames) > 0
+}
+
+// VerifyPeerCertificate can be used as tls.Config.VerifyPeerCertificate
+func (s *SecuritySettings) VerifyPeerCertificate(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return fmt.Errorf("remote certificate missing")
+	}
+
+	certs := make([]*x509.Certificate, 0, len(rawCerts))
+	for _, raw := range rawCerts {
+		c, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+
+		certs = append(certs, c)
+	}
+
+	if s.matchCertificate(certs, s.AdminClientCertThumbprints, s.AdminClientNames) == nil {
+		return nil
+	}
+
+	return s.matchCertificate(certs, s.RemoteCertThumbprints, s.RemoteNames)
+}
+
+func (s *SecuritySettings) matchCertificate(certs []*x509.Certificate, thumbprints []string, names []X509Name) error {
+	leaf := certs[0]
+	thumbprint := CertThumbprint(leaf)
+
+	if containsThumbprint(thumbprints, thumbprint) {
+		return nil
+	}
+
+	// the same common name may be listed with different issuers, any of them can accept
+	var issuerErr error
+	for _, name := range names {
+		if !strings.EqualFold(leaf.Subject.CommonName, name.CommonName) {
+			continue
+		}
+
+		err := s.verifyIssuer(leaf, certs[1:], name.IssuerThumbprints)
+		if err == nil {
+			return nil
+		}
+
+		issuerErr = err
+	}
+
+	if issuerErr != nil {
+		return issuerErr
+	}
+
+	return fmt.Errorf("remote certificate %v [%v] not allowed", leaf.Subject.CommonName, thumbprint)
+}
+
+// Authorizer classifies clients by their certificate, it can be used as ServerConfig.Authorizer
+func (s *SecuritySettings) Authorizer() ConnectionAuthorizer {
+	return func(info *ConnectionAuthInfo) (RoleMask, error) {
+		if len(info.PeerCertificates) == 0 {
+			return RoleMaskUser, nil
+		}
+
+		if s.matchCertificate(info.PeerCertificates, s.AdminClientCertThumbprints, s.AdminClientNames) == nil {
+			return RoleMaskAdmin, nil
+		}
+
+		return RoleMaskUser, nil
+	}
+}
+
+func (s *SecuritySettings) verifyIssuer(leaf *x509.Certificate, intermediates []*x509.Certificate, issuerThumbprints []string) error {
+	if len(issuerThumbprints) == 0 {
+		pool := x509.NewCertPool()
+		for _, c := range intermediates {
+			pool.AddCert(c)
+		}
+
+		_, err := leaf.Verify(x509.VerifyOptions{
+			Roots:         s.RootCAs,
+			Intermediates: pool,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		})
+
+		return err
+	}
+
+	now := time.Now()
+	if now.Before(leaf.NotBefore) || now.After(leaf.NotAfter) {
+		return fmt.Errorf("remote certificate %v expired or not yet valid", leaf.Subject.CommonName)
+	}
+
+	for _, issuer := range intermediates {
+		if leaf.CheckSignatureFrom(issuer) != nil {
+			continue
+		}
+
+		if containsThumbprint(issuerThumbprints, CertThumbprint(issuer)) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("remote certificate %v issuer not allowed", leaf.Subject.CommonName)
+}
+
+func (s *SecuritySettings) certificates() []tls.Certificate {
+	if s.Certificate == nil {
+		return nil
+	}
+
+	return []tls.Certificate{*s.Certificate}
+}
+
+// ClientTLSConfig verifies the server by the remote rules instead of hostname
+func (s *SecuritySettings) ClientTLSConfig() (*tls.Config, error) {
+	if !s.hasRemoteRules() {
+		return nil, fmt.Errorf("no remote certificate thumbprint or common name configured")
+	}
+
+	return &tls.Config{
+		Certificates:          s.certificates(),
+		InsecureSkipVerify:    true, // verified by VerifyPeerCertificate
+		VerifyPeerCertificate: s.VerifyPeerCertificate,
+	}, nil
+}
+
+// ServerTLSConfig requires a client certificate matching the remote rules,
+// no client certificate is requested if no rule is set, e.g. clients using claims
+func (s *SecuritySettings) ServerTLSConfig() (*tls.Config, error) {
+	if s.Certificate == nil {
+		return nil, fmt.Errorf("server certificate missing")
+	}
+
+	conf := &tls.Config{
+		Certificates: s.certificates(),
+		ClientAuth:   tls.NoClientCert,
+	}
+
+	if s.hasRemoteRules() {
+		conf.ClientAuth = tls.RequireAnyClientCert
+		conf.VerifyPeerCertificate = s.VerifyPeerCertificate
+	}
+
+	return conf, nil
+}
+
+func LoadCertificatePEM(certFile, keyFile string) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &cert, nil
+}
+
+func LoadCertificatePFX(file, password string) (*tls.Certificate, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	blocks, err := pkcs12.ToPEM(data, password)
+	if err != nil {
+		return nil, err
+	}
+
+	var certPem, keyPem []byte
+	var leaf []byte
+
+	for _, b := range blocks {
+		if b.Type == "CERTIFICATE" {
+			// leaf must be the first one in chain
+			if _, ok := b.Headers["localKeyId"]; ok && leaf == nil {
+				leaf = pem.EncodeToMemory(b)
+				continue
+			}
+
+			certPem = append(certPem, pem.EncodeToMemory(b)...)
+		} else {
+			keyPem = pem.EncodeToMemory(b)
+		}
+	}
+
+	certPem = append(leaf, certPem...)
+
+	cert, err := tls.X509KeyPair(certPem, keyPem)
+	if err != nil {
+		return nil, err
+	}
+
+	return &cert, nil
+}
+
+// LinuxCertificateStore is where Service Fabric on Linux keeps certificates as <thumbprint>.crt and <thumbprint>.prv
+const LinuxCertificateStore = "/var/lib/sfcerts"
+
+// FindCertificateByThumbprint loads a certificate from a directory laid out like LinuxCertificateStore
+func FindCertificateByThumbprint(dir, thumbprint string) (*tls.Certificate, error) {
+	thumbprint = normalizeThumbprint(thumbprint)
+
+	for _, name := range []string{strings.ToUpper(thumbprint), thumbprint} {
+		certFile := filepath.Join(dir, name+".crt")
+		if _, err := os.Stat(certFile); err != nil {
+			continue
+		}
+
+		cert, err := LoadCertificatePEM(certFile, filepath.Join(dir, name+".prv"))
+		if err != nil {
+			return nil, err
+		}
+
+		return cert, nil
+	}
+
+	return nil, fmt.Errorf("certificate %v not found in %v", thumbprint, dir)
+}
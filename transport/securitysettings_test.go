@@ -0,0 +1,309 @@
+package transport
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPem []byte
+	keyPem  []byte
+}
+
+func (c *testCert) tlsCertificate(t *testing.T, chain ...*testCert) *tls.Certificate {
+	cert := tls.Certificate{
+		Certificate: [][]byte{c.cert.Raw},
+		PrivateKey:  c.key,
+	}
+
+	for _, i := range chain {
+		cert.Certificate = append(cert.Certificate, i.cert.Raw)
+	}
+
+	return &cert
+}
+
+func mustCreateTestCert(t *testing.T, cn string, issuer *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+
+		BasicConstraintsValid: true,
+		IsCA:                  issuer == nil,
+	}
+
+	parent := tmpl
+	signer := key
+	if issuer != nil {
+		parent = issuer.cert
+		signer = issuer.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPem:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}),
+	}
+}
+
+func TestVerifyPeerCertificate(t *testing.T) {
+	ca := mustCreateTestCert(t, "ca", nil)
+	otherCa := mustCreateTestCert(t, "otherca", nil)
+	server := mustCreateTestCert(t, "server.cluster", ca)
+	rogue := mustCreateTestCert(t, "server.cluster", otherCa)
+
+	chain := func(c ...*testCert) [][]byte {
+		var raw [][]byte
+		for _, i := range c {
+			raw = append(raw, i.cert.Raw)
+		}
+		return raw
+	}
+
+	t.Run("thumbprint", func(t *testing.T) {
+		s := SecuritySettings{
+			RemoteCertThumbprints: []string{strings.ToUpper(CertThumbprint(server.cert))},
+		}
+
+		assert.NoError(t, s.VerifyPeerCertificate(chain(server), nil))
+		assert.Error(t, s.VerifyPeerCertificate(chain(rogue), nil))
+	})
+
+	t.Run("secondary thumbprint", func(t *testing.T) {
+		s := SecuritySettings{
+			RemoteCertThumbprints: []string{CertThumbprint(ca.cert), CertThumbprint(rogue.cert)},
+		}
+
+		assert.NoError(t, s.VerifyPeerCertificate(chain(rogue), nil))
+		assert.Error(t, s.VerifyPeerCertificate(chain(server), nil))
+	})
+
+	t.Run("common name with issuer pinning", func(t *testing.T) {
+		s := SecuritySettings{
+			RemoteNames: []X509Name{
+				{CommonName: "server.cluster", IssuerThumbprints: []string{CertThumbprint(ca.cert)}},
+			},
+		}
+
+		assert.NoError(t, s.VerifyPeerCertificate(chain(server, ca), nil))
+		assert.Error(t, s.VerifyPeerCertificate(chain(rogue, otherCa), nil))
+		assert.Error(t, s.VerifyPeerCertificate(chain(server), nil))
+	})
+
+	t.Run("common name listed with several issuers", func(t *testing.T) {
+		s := SecuritySettings{
+			RemoteNames: []X509Name{
+				{CommonName: "server.cluster", IssuerThumbprints: []string{CertThumbprint(otherCa.cert)}},
+				{CommonName: "server.cluster", IssuerThumbprints: []string{CertThumbprint(ca.cert)}},
+			},
+		}
+
+		assert.NoError(t, s.VerifyPeerCertificate(chain(server, ca), nil))
+		assert.NoError(t, s.VerifyPeerCertificate(chain(rogue, otherCa), nil))
+		assert.Error(t, s.VerifyPeerCertificate(chain(server), nil))
+	})
+
+	t.Run("common name with roots", func(t *testing.T) {
+		pool := x509.NewCertPool()
+		pool.AddCert(ca.cert)
+
+		s := SecuritySettings{
+			RemoteNames: []X509Name{{CommonName: "server.cluster"}},
+			RootCAs:     pool,
+		}
+
+		assert.NoError(t, s.VerifyPeerCertificate(chain(server), nil))
+		assert.Error(t, s.VerifyPeerCertificate(chain(rogue), nil))
+	})
+
+	t.Run("no rules", func(t *testing.T) {
+		s := SecuritySettings{}
+		assert.Error(t, s.VerifyPeerCertificate(chain(server), nil))
+
+		_, err := s.ClientTLSConfig()
+		assert.Error(t, err)
+	})
+}
+
+func TestSecuritySettingsTLS(t *testing.T) {
+	ca := mustCreateTestCert(t, "ca", nil)
+	serverCert := mustCreateTestCert(t, "server.cluster", ca)
+	clientCert := mustCreateTestCert(t, "client.cluster", ca)
+
+	serverSettings := SecuritySettings{
+		Certificate: serverCert.tlsCertificate(t, ca),
+		RemoteNames: []X509Name{
+			{CommonName: "client.cluster", IssuerThumbprints: []string{CertThumbprint(ca.cert)}},
+		},
+	}
+
+	serverTls, err := serverSettings.ServerTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	network := NewMemoryNetwork()
+	server, err := ListenMemory(network, "x509:0", ServerConfig{
+		Config: Config{
+			TLS: serverTls,
+		},
+		MessageCallback: func(c Conn, bam *ByteArrayMessage) {
+			msg := &Message{}
+			msg.Headers.RelatesTo = bam.Headers.Id
+			if err := c.SendOneWay(msg); err != nil {
+				t.Error(err)
+			}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	go server.Serve()
+
+	dial := func(settings SecuritySettings) error {
+		clientTls, err := settings.ClientTLSConfig()
+		if err != nil {
+			return err
+		}
+
+		client, err := DialMemory(network, server.Addr().String(), ClientConfig{
+			Config: Config{
+				TLS: clientTls,
+			},
+		})
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+		go client.Wait()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		_, err = client.RequestReply(ctx, &Message{})
+		return err
+	}
+
+	t.Run("accepted", func(t *testing.T) {
+		assert.NoError(t, dial(SecuritySettings{
+			Certificate:           clientCert.tlsCertificate(t, ca),
+			RemoteCertThumbprints: []string{CertThumbprint(serverCert.cert)},
+		}))
+	})
+
+	t.Run("server thumbprint mismatch", func(t *testing.T) {
+		assert.Error(t, dial(SecuritySettings{
+			Certificate:           clientCert.tlsCertificate(t, ca),
+			RemoteCertThumbprints: []string{CertThumbprint(clientCert.cert)},
+		}))
+	})
+
+	t.Run("client without issuer", func(t *testing.T) {
+		assert.Error(t, dial(SecuritySettings{
+			Certificate:           clientCert.tlsCertificate(t),
+			RemoteCertThumbprints: []string{CertThumbprint(serverCert.cert)},
+		}))
+	})
+}
+
+func TestFindCertificateByThumbprint(t *testing.T) {
+	c := mustCreateTestCert(t, "node", nil)
+	thumbprint := CertThumbprint(c.cert)
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, strings.ToUpper(thumbprint)+".crt"), c.certPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, strings.ToUpper(thumbprint)+".prv"), c.keyPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := FindCertificateByThumbprint(dir, thumbprint)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, c.cert.Raw, cert.Certificate[0])
+
+	_, err = FindCertificateByThumbprint(dir, CertThumbprint(mustCreateTestCert(t, "other", nil).cert))
+	assert.Error(t, err)
+
+	_, err = LoadCertificatePFX(filepath.Join(dir, "missing.pfx"), "")
+	assert.Error(t, err)
+}
+
+func TestSecuritySettingsAuthorizer(t *testing.T) {
+	ca := mustCreateTestCert(t, "ca", nil)
+	admin := mustCreateTestCert(t, "admin.cluster", ca)
+	user := mustCreateTestCert(t, "user.cluster", ca)
+
+	s := SecuritySettings{
+		RemoteNames: []X509Name{
+			{CommonName: "user.cluster", IssuerThumbprints: []string{CertThumbprint(ca.cert)}},
+		},
+		AdminClientNames: []X509Name{
+			{CommonName: "admin.cluster", IssuerThumbprints: []string{CertThumbprint(ca.cert)}},
+		},
+	}
+
+	assert.NoError(t, s.VerifyPeerCertificate([][]byte{admin.cert.Raw, ca.cert.Raw}, nil))
+	assert.NoError(t, s.VerifyPeerCertificate([][]byte{user.cert.Raw, ca.cert.Raw}, nil))
+
+	authorizer := s.Authorizer()
+
+	role, err := authorizer(&ConnectionAuthInfo{PeerCertificates: []*x509.Certificate{admin.cert, ca.cert}})
+	assert.NoError(t, err)
+	assert.Equal(t, RoleMaskAdmin, role)
+
+	role, err = authorizer(&ConnectionAuthInfo{PeerCertificates: []*x509.Certificate{user.cert, ca.cert}})
+	assert.NoError(t, err)
+	assert.Equal(t, RoleMaskUser, role)
+}
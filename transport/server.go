@@ -1,19 +1,26 @@
 package transport
 
 import (
-	"log"
 	"net"
+
+	"github.com/tg123/phabrik/common"
 )
 
 type Server struct {
 	listener        net.Listener
 	messageCallback MessageCallback
 	config          ServerConfig
+	logger          common.Logger
 }
 
+type DisconnectCallback func(Conn, error)
+
 type ServerConfig struct {
 	Config
-	MessageCallback MessageCallback
+	MessageCallback    MessageCallback
+	DisconnectCallback DisconnectCallback
+	// Authorizer is called with the first message of each connection, all clients are admin if nil
+	Authorizer ConnectionAuthorizer
 }
 
 func ListenTCP(addr string, config ServerConfig) (*Server, error) {
@@ -25,11 +32,30 @@ func ListenTCP(addr string, config ServerConfig) (*Server, error) {
 	return Listen(l, config)
 }
 
+func ListenUnix(path string, config ServerConfig) (*Server, error) {
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	return Listen(l, config)
+}
+
+func ListenMemory(network *MemoryNetwork, addr string, config ServerConfig) (*Server, error) {
+	l, err := network.Listen(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return Listen(l, config)
+}
+
 func Listen(l net.Listener, config ServerConfig) (*Server, error) {
 	return &Server{
 		listener:        l,
 		messageCallback: config.MessageCallback,
 		config:          config,
+		logger:          common.LoggerOrDefault(config.Logger),
 	}, nil
 }
 
@@ -53,27 +79,53 @@ func (s *Server) handle(conn net.Conn) error {
 
 	c.messageCallback = s.onMessage
 
-	return c.Wait()
+	if s.config.Authorizer != nil {
+		first, err := c.authorize(s.config.Authorizer)
+		if err != nil {
+			return err
+		}
+
+		if err := c.dispatch(first); err != nil {
+			return err
+		}
+	}
+
+	err = c.Wait()
+
+	if s.config.DisconnectCallback != nil {
+		s.config.DisconnectCallback(c, err)
+	}
+
+	return err
 }
 
 func (s *Server) SetMessageCallback(cb MessageCallback) {
 	s.messageCallback = cb
 }
 
+// SetUncorrelatedReplyCallback replaces Config.UncorrelatedReplyCallback of connections accepted afterwards
+func (s *Server) SetUncorrelatedReplyCallback(cb MessageCallback) {
+	s.config.UncorrelatedReplyCallback = cb
+}
+
 func (s *Server) Serve() error {
 
 	for {
 		c, err := s.listener.Accept()
 		if err != nil {
 			if neterr, ok := err.(net.Error); ok && neterr.Temporary() {
-				log.Printf("accepting error %v", err)
+				s.logger.Warn("accepting error", common.LogKeyError, err)
 				continue
 			}
 
 			return err
 		}
 
-		go s.handle(c)
+		go func() {
+			if err := s.handle(c); err != nil {
+				s.logger.Debug("connection closed", common.LogKeyConn, c.RemoteAddr(), common.LogKeyError, err)
+			}
+		}()
 	}
 }
 
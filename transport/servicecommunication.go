@@ -0,0 +1,487 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/tg123/phabrik/common"
+	"github.com/tg123/phabrik/serialization"
+)
+
+func init() {
+	RegisterHeaderActivator(MessageHeaderIdTypeServiceLocationActor, func() interface{} {
+		return &ServiceLocationActorHeader{}
+	})
+	RegisterHeaderActivator(MessageHeaderIdTypeTcpServiceMessageHeader, func() interface{} {
+		return &TcpServiceMessageHeader{}
+	})
+	RegisterHeaderActivator(MessageHeaderIdTypeTcpClientIdHeader, func() interface{} {
+		return &TcpClientIdHeader{}
+	})
+	RegisterHeaderActivator(MessageHeaderIdTypeServiceCommunicationError, func() interface{} {
+		return &ServiceCommunicationErrorHeader{}
+	})
+	RegisterHeaderActivator(MessageHeaderIdTypeIsAsyncOperationHeader, func() interface{} {
+		return &IsAsyncOperationHeader{}
+	})
+}
+
+// ServiceLocationActorHeader routes a message to one of the service locations sharing a listener
+type ServiceLocationActorHeader struct {
+	Actor string
+}
+
+type TcpServiceMessageKind int32
+
+const (
+	TcpServiceMessageRequest TcpServiceMessageKind = iota
+	TcpServiceMessageOneWay
+	TcpServiceMessageConnect
+	TcpServiceMessageDisconnect
+)
+
+// TcpServiceMessageHeader tells user messages from connect and disconnect of clients
+type TcpServiceMessageHeader struct {
+	Kind TcpServiceMessageKind
+}
+
+// TcpClientIdHeader identifies the client, the listener sends callbacks to a client by it
+type TcpClientIdHeader struct {
+	ClientId string
+}
+
+// ServiceCommunicationErrorHeader is attached to replies of failed requests
+type ServiceCommunicationErrorHeader struct {
+	ErrorCode FabricErrorCode
+}
+
+type IsAsyncOperationHeader struct {
+	IsAsyncOperation bool
+}
+
+func (h *MessageHeaders) ServiceLocationActor() (ServiceLocationActorHeader, bool) {
+	v, ok := h.GetFirstCustomHeader(MessageHeaderIdTypeServiceLocationActor)
+	if !ok {
+		return ServiceLocationActorHeader{}, false
+	}
+
+	sh, ok := v.(*ServiceLocationActorHeader)
+	if !ok {
+		return ServiceLocationActorHeader{}, false
+	}
+
+	return *sh, true
+}
+
+func (h *MessageHeaders) SetServiceLocationActor(header ServiceLocationActorHeader) {
+	h.ReplaceCustomHeader(MessageHeaderIdTypeServiceLocationActor, &header)
+}
+
+func (h *MessageHeaders) TcpServiceMessage() (TcpServiceMessageHeader, bool) {
+	v, ok := h.GetFirstCustomHeader(MessageHeaderIdTypeTcpServiceMessageHeader)
+	if !ok {
+		return TcpServiceMessageHeader{}, false
+	}
+
+	sh, ok := v.(*TcpServiceMessageHeader)
+	if !ok {
+		return TcpServiceMessageHeader{}, false
+	}
+
+	return *sh, true
+}
+
+func (h *MessageHeaders) SetTcpServiceMessage(header TcpServiceMessageHeader) {
+	h.ReplaceCustomHeader(MessageHeaderIdTypeTcpServiceMessageHeader, &header)
+}
+
+func (h *MessageHeaders) TcpClientId() (TcpClientIdHeader, bool) {
+	v, ok := h.GetFirstCustomHeader(MessageHeaderIdTypeTcpClientIdHeader)
+	if !ok {
+		return TcpClientIdHeader{}, false
+	}
+
+	sh, ok := v.(*TcpClientIdHeader)
+	if !ok {
+		return TcpClientIdHeader{}, false
+	}
+
+	return *sh, true
+}
+
+func (h *MessageHeaders) SetTcpClientId(header TcpClientIdHeader) {
+	h.ReplaceCustomHeader(MessageHeaderIdTypeTcpClientIdHeader, &header)
+}
+
+func (h *MessageHeaders) ServiceCommunicationError() (ServiceCommunicationErrorHeader, bool) {
+	v, ok := h.GetFirstCustomHeader(MessageHeaderIdTypeServiceCommunicationError)
+	if !ok {
+		return ServiceCommunicationErrorHeader{}, false
+	}
+
+	sh, ok := v.(*ServiceCommunicationErrorHeader)
+	if !ok {
+		return ServiceCommunicationErrorHeader{}, false
+	}
+
+	return *sh, true
+}
+
+func (h *MessageHeaders) SetServiceCommunicationError(header ServiceCommunicationErrorHeader) {
+	h.ReplaceCustomHeader(MessageHeaderIdTypeServiceCommunicationError, &header)
+}
+
+func (h *MessageHeaders) IsAsyncOperation() (IsAsyncOperationHeader, bool) {
+	v, ok := h.GetFirstCustomHeader(MessageHeaderIdTypeIsAsyncOperationHeader)
+	if !ok {
+		return IsAsyncOperationHeader{}, false
+	}
+
+	sh, ok := v.(*IsAsyncOperationHeader)
+	if !ok {
+		return IsAsyncOperationHeader{}, false
+	}
+
+	return *sh, true
+}
+
+func (h *MessageHeaders) SetIsAsyncOperation(header IsAsyncOperationHeader) {
+	h.ReplaceCustomHeader(MessageHeaderIdTypeIsAsyncOperationHeader, &header)
+}
+
+// ServiceLocationHandler serves one service location of a ServiceCommunicationListener, only RequestHandler is required
+type ServiceLocationHandler struct {
+	// RequestHandler returns the reply, return a *FabricError to control the error code sent back
+	RequestHandler    func(ctx context.Context, clientId string, request *ByteArrayMessage) (*Message, error)
+	OneWayHandler     func(clientId string, message *ByteArrayMessage)
+	ConnectHandler    func(clientId string)
+	DisconnectHandler func(clientId string)
+}
+
+type ServiceCommunicationListenerConfig struct {
+	Config
+}
+
+type serviceClientKey struct {
+	location string
+	clientId string
+}
+
+// ServiceCommunicationListener hosts multiple service locations on one listener,
+// messages are routed by ServiceLocationActorHeader
+type ServiceCommunicationListener struct {
+	server    *Server
+	locations sync.Map
+	clients   sync.Map
+	logger    common.Logger
+}
+
+func ListenServiceCommunication(l net.Listener, config ServiceCommunicationListenerConfig) (*ServiceCommunicationListener, error) {
+	s := &ServiceCommunicationListener{
+		logger: common.LoggerOrDefault(config.Logger),
+	}
+
+	server, err := Listen(l, ServerConfig{
+		Config:             config.Config,
+		MessageCallback:    s.onMessage,
+		DisconnectCallback: s.onDisconnect,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.server = server
+	return s, nil
+}
+
+func (s *ServiceCommunicationListener) Register(location string, handler ServiceLocationHandler) error {
+	if handler.RequestHandler == nil {
+		return fmt.Errorf("RequestHandler must not be nil")
+	}
+
+	if _, loaded := s.locations.LoadOrStore(location, &handler); loaded {
+		return fmt.Errorf("service location %v already registered", location)
+	}
+
+	return nil
+}
+
+func (s *ServiceCommunicationListener) Unregister(location string) {
+	s.locations.Delete(location)
+	s.clients.Range(func(key, value interface{}) bool {
+		if key.(serviceClientKey).location == location {
+			s.clients.Delete(key)
+		}
+		return true
+	})
+}
+
+func (s *ServiceCommunicationListener) onMessage(conn Conn, bam *ByteArrayMessage) {
+	if bam.Headers.Actor != MessageActorTypeServiceCommunicationActor {
+		s.logger.Debug("service communication message with unexpected actor dropped", common.LogKeyMessageId, bam.Headers.Id, "actor", bam.Headers.Actor)
+		return
+	}
+
+	location, _ := bam.Headers.ServiceLocationActor()
+	clientId, _ := bam.Headers.TcpClientId()
+	kind, _ := bam.Headers.TcpServiceMessage()
+
+	v, ok := s.locations.Load(location.Actor)
+	if !ok {
+		s.reply(conn, bam, nil, &FabricError{
+			Code:    FabricErrorCodeServiceDoesNotExist,
+			Message: fmt.Sprintf("service location %v not found", location.Actor),
+		})
+		return
+	}
+
+	handler := v.(*ServiceLocationHandler)
+	key := serviceClientKey{location: location.Actor, clientId: clientId.ClientId}
+
+	switch kind.Kind {
+	case TcpServiceMessageConnect:
+		s.clients.Store(key, conn)
+		if handler.ConnectHandler != nil {
+			handler.ConnectHandler(clientId.ClientId)
+		}
+
+		s.reply(conn, bam, &Message{}, nil)
+	case TcpServiceMessageDisconnect:
+		s.disconnect(key)
+	case TcpServiceMessageOneWay:
+		if handler.OneWayHandler != nil {
+			handler.OneWayHandler(clientId.ClientId, bam)
+		}
+	default:
+		ctx := context.Background()
+		if a, ok := bam.Headers.FabricActivity(); ok {
+			ctx = ContextWithActivity(ctx, a)
+		}
+
+		if timeout, ok := bam.Headers.Timeout(); ok && timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+
+		reply, err := handler.RequestHandler(ctx, clientId.ClientId, bam)
+		s.reply(conn, bam, reply, err)
+	}
+}
+
+func (s *ServiceCommunicationListener) disconnect(key serviceClientKey) {
+	if _, ok := s.clients.LoadAndDelete(key); !ok {
+		return
+	}
+
+	if v, ok := s.locations.Load(key.location); ok {
+		if h := v.(*ServiceLocationHandler); h.DisconnectHandler != nil {
+			h.DisconnectHandler(key.clientId)
+		}
+	}
+}
+
+func (s *ServiceCommunicationListener) onDisconnect(conn Conn, err error) {
+	s.clients.Range(func(key, value interface{}) bool {
+		if value == conn {
+			s.disconnect(key.(serviceClientKey))
+		}
+		return true
+	})
+}
+
+func (s *ServiceCommunicationListener) reply(conn Conn, request *ByteArrayMessage, reply *Message, err error) {
+	if !request.Headers.ExpectsReply {
+		return
+	}
+
+	if reply == nil {
+		reply = &Message{}
+	}
+
+	if err != nil {
+		code := FabricErrorCodeFail
+
+		var fe *FabricError
+		if errors.As(err, &fe) {
+			code = fe.Code
+		}
+
+		reply = &Message{Body: &serviceCommunicationErrorBody{Message: err.Error()}}
+		reply.Headers.SetServiceCommunicationError(ServiceCommunicationErrorHeader{ErrorCode: code})
+	}
+
+	reply.Headers.Actor = MessageActorTypeServiceCommunicationActor
+	reply.Headers.RelatesTo = request.Headers.Id
+
+	if err := conn.SendOneWay(reply); err != nil {
+		s.logger.Debug("service communication reply failed", common.LogKeyMessageId, request.Headers.Id, common.LogKeyError, err)
+	}
+}
+
+type serviceCommunicationErrorBody struct {
+	Message string
+}
+
+// SendOneWay sends a callback message to a client connected to a location
+func (s *ServiceCommunicationListener) SendOneWay(location, clientId string, message *Message) error {
+	v, ok := s.clients.Load(serviceClientKey{location: location, clientId: clientId})
+	if !ok {
+		return fmt.Errorf("client %v not connected to %v", clientId, location)
+	}
+
+	message.Headers.Actor = MessageActorTypeServiceCommunicationActor
+	message.Headers.SetServiceLocationActor(ServiceLocationActorHeader{Actor: location})
+	message.Headers.SetTcpServiceMessage(TcpServiceMessageHeader{Kind: TcpServiceMessageOneWay})
+
+	return v.(Conn).SendOneWay(message)
+}
+
+// Clients returns ids of clients connected to a location
+func (s *ServiceCommunicationListener) Clients(location string) []string {
+	var ids []string
+	s.clients.Range(func(key, value interface{}) bool {
+		if k := key.(serviceClientKey); k.location == location {
+			ids = append(ids, k.clientId)
+		}
+		return true
+	})
+
+	return ids
+}
+
+func (s *ServiceCommunicationListener) Addr() net.Addr {
+	return s.server.Addr()
+}
+
+func (s *ServiceCommunicationListener) Serve() error {
+	return s.server.Serve()
+}
+
+func (s *ServiceCommunicationListener) Close() error {
+	return s.server.Close()
+}
+
+type ServiceCommunicationClientConfig struct {
+	Config
+	ServiceLocation string
+	// ClientId is generated if empty
+	ClientId string
+	// MessageCallback receives callbacks sent by the listener to this client
+	MessageCallback MessageCallback
+}
+
+// ServiceCommunicationClient talks to one service location of a ServiceCommunicationListener
+type ServiceCommunicationClient struct {
+	client   *Client
+	location string
+	clientId string
+}
+
+func DialServiceCommunication(addr string, config ServiceCommunicationClientConfig) (*ServiceCommunicationClient, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewServiceCommunicationClient(conn, config)
+}
+
+// NewServiceCommunicationClient wraps conn, call Connect to register at the service location
+func NewServiceCommunicationClient(conn net.Conn, config ServiceCommunicationClientConfig) (*ServiceCommunicationClient, error) {
+	if config.ClientId == "" {
+		g, err := serialization.NewGuidV4()
+		if err != nil {
+			return nil, err
+		}
+
+		config.ClientId = g.String()
+	}
+
+	client, err := Connect(conn, ClientConfig{
+		Config:          config.Config,
+		MessageCallback: config.MessageCallback,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &ServiceCommunicationClient{
+		client:   client,
+		location: config.ServiceLocation,
+		clientId: config.ClientId,
+	}, nil
+}
+
+func (c *ServiceCommunicationClient) ClientId() string {
+	return c.clientId
+}
+
+func (c *ServiceCommunicationClient) prepare(message *Message, kind TcpServiceMessageKind) {
+	message.Headers.Actor = MessageActorTypeServiceCommunicationActor
+	message.Headers.SetServiceLocationActor(ServiceLocationActorHeader{Actor: c.location})
+	message.Headers.SetTcpClientId(TcpClientIdHeader{ClientId: c.clientId})
+	message.Headers.SetTcpServiceMessage(TcpServiceMessageHeader{Kind: kind})
+}
+
+// Connect registers the client at the service location so that it can receive callbacks
+func (c *ServiceCommunicationClient) Connect(ctx context.Context) error {
+	msg := &Message{}
+	c.prepare(msg, TcpServiceMessageConnect)
+
+	_, err := c.requestReply(ctx, msg)
+	return err
+}
+
+// RequestReply sends a request, a reply with ServiceCommunicationErrorHeader is returned as *FabricError
+func (c *ServiceCommunicationClient) RequestReply(ctx context.Context, message *Message) (*ByteArrayMessage, error) {
+	c.prepare(message, TcpServiceMessageRequest)
+	message.Headers.SetIsAsyncOperation(IsAsyncOperationHeader{IsAsyncOperation: true})
+
+	return c.requestReply(ctx, message)
+}
+
+func (c *ServiceCommunicationClient) requestReply(ctx context.Context, message *Message) (*ByteArrayMessage, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		message.Headers.SetTimeout(time.Until(deadline))
+	}
+
+	reply, err := c.client.RequestReply(ctx, message)
+	if err != nil {
+		return nil, err
+	}
+
+	if h, ok := reply.Headers.ServiceCommunicationError(); ok && h.ErrorCode != FabricErrorCodeSuccess {
+		var b serviceCommunicationErrorBody
+		serialization.Unmarshal(reply.Body, &b) // ignore error
+
+		return nil, &FabricError{
+			Code:    h.ErrorCode,
+			Message: b.Message,
+		}
+	}
+
+	return reply, nil
+}
+
+func (c *ServiceCommunicationClient) SendOneWay(message *Message) error {
+	c.prepare(message, TcpServiceMessageOneWay)
+	return c.client.SendOneWay(message)
+}
+
+func (c *ServiceCommunicationClient) Wait() error {
+	return c.client.Wait()
+}
+
+// Close tells the listener the client is leaving before closing the connection
+func (c *ServiceCommunicationClient) Close() error {
+	msg := &Message{}
+	c.prepare(msg, TcpServiceMessageDisconnect)
+	c.client.SendOneWay(msg) // best effort
+
+	return c.client.Close()
+}
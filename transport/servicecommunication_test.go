@@ -0,0 +1,141 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServiceCommunication(t *testing.T) {
+	network := NewMemoryNetwork()
+	l, err := network.Listen("servicecomm:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := ListenServiceCommunication(l, ServiceCommunicationListenerConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go listener.Serve()
+
+	echo := func(prefix string) func(ctx context.Context, clientId string, request *ByteArrayMessage) (*Message, error) {
+		return func(ctx context.Context, clientId string, request *ByteArrayMessage) (*Message, error) {
+			if string(request.Body) == "fail" {
+				return nil, &FabricError{Code: FabricErrorCodeNotReady, Message: "not ready"}
+			}
+
+			return &Message{Body: append([]byte(prefix), request.Body...)}, nil
+		}
+	}
+
+	oneway := make(chan string, 1)
+	connected := make(chan string, 1)
+	disconnected := make(chan string, 1)
+
+	assert.NoError(t, listener.Register("a", ServiceLocationHandler{
+		RequestHandler: echo("a:"),
+		OneWayHandler: func(clientId string, message *ByteArrayMessage) {
+			oneway <- string(message.Body)
+		},
+		ConnectHandler: func(clientId string) {
+			connected <- clientId
+		},
+		DisconnectHandler: func(clientId string) {
+			disconnected <- clientId
+		},
+	}))
+	assert.NoError(t, listener.Register("b", ServiceLocationHandler{RequestHandler: echo("b:")}))
+	assert.Error(t, listener.Register("b", ServiceLocationHandler{RequestHandler: echo("b:")}))
+
+	callbacks := make(chan string, 1)
+
+	dial := func(location string) *ServiceCommunicationClient {
+		conn, err := network.Dial(listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c, err := NewServiceCommunicationClient(conn, ServiceCommunicationClientConfig{
+			ServiceLocation: location,
+			MessageCallback: func(conn Conn, bam *ByteArrayMessage) {
+				callbacks <- string(bam.Body)
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		go c.Wait()
+
+		return c
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	a := dial("a")
+	assert.NoError(t, a.Connect(ctx))
+	assert.Equal(t, a.ClientId(), <-connected)
+
+	b := dial("b")
+	defer b.Close()
+	assert.NoError(t, b.Connect(ctx))
+
+	t.Run("routing", func(t *testing.T) {
+		reply, err := a.RequestReply(ctx, &Message{Body: []byte("x")})
+		assert.NoError(t, err)
+		assert.Equal(t, "a:x", string(reply.Body))
+
+		reply, err = b.RequestReply(ctx, &Message{Body: []byte("y")})
+		assert.NoError(t, err)
+		assert.Equal(t, "b:y", string(reply.Body))
+	})
+
+	t.Run("error code", func(t *testing.T) {
+		_, err := a.RequestReply(ctx, &Message{Body: []byte("fail")})
+
+		var fe *FabricError
+		if !errors.As(err, &fe) {
+			t.Fatalf("expected FabricError, got %v", err)
+		}
+		assert.Equal(t, FabricErrorCodeNotReady, fe.Code)
+		assert.Contains(t, fe.Message, "not ready")
+	})
+
+	t.Run("unknown location", func(t *testing.T) {
+		c := dial("missing")
+		defer c.Close()
+
+		err := c.Connect(ctx)
+		assert.Equal(t, FabricErrorCodeServiceDoesNotExist, ErrorCodeOf(err))
+	})
+
+	t.Run("one way", func(t *testing.T) {
+		assert.NoError(t, a.SendOneWay(&Message{Body: []byte("hello")}))
+		assert.Equal(t, "hello", <-oneway)
+	})
+
+	t.Run("callback", func(t *testing.T) {
+		ids := append(listener.Clients("a"), listener.Clients("b")...)
+		sort.Strings(ids)
+		expected := []string{a.ClientId(), b.ClientId()}
+		sort.Strings(expected)
+		assert.Equal(t, expected, ids)
+
+		assert.NoError(t, listener.SendOneWay("a", a.ClientId(), &Message{Body: []byte("notify")}))
+		assert.Equal(t, "notify", <-callbacks)
+
+		assert.Error(t, listener.SendOneWay("b", a.ClientId(), &Message{}))
+	})
+
+	t.Run("disconnect", func(t *testing.T) {
+		assert.NoError(t, a.Close())
+		assert.Equal(t, a.ClientId(), <-disconnected)
+		assert.Empty(t, listener.Clients("a"))
+	})
+}
@@ -17,12 +17,12 @@ type fabricSecureConn struct {
 	frameWCfg          frameWriteConfig
 }
 
-func createTlsConn(conn net.Conn, mf *messageFactory, tlsconf *tls.Config, factory func(conn net.Conn, config *tls.Config) *tls.Conn, initbuf []byte) (*tls.Conn, error) {
+func createTlsConn(conn net.Conn, mf *messageFactory, tlsconf *tls.Config, provider securityProvider, factory func(conn net.Conn, config *tls.Config) *tls.Conn, initbuf []byte) (*tls.Conn, error) {
 	rawtls := &fabricSecureConn{
 		rawconn: conn,
 		mf:      mf,
 	}
-	rawtls.frameWCfg.SecurityProviderMask = securityProviderSsl
+	rawtls.frameWCfg.SecurityProviderMask = provider
 	if initbuf != nil {
 		rawtls.rbuf.Write(initbuf)
 	}
@@ -37,12 +37,12 @@ func createTlsConn(conn net.Conn, mf *messageFactory, tlsconf *tls.Config, facto
 	return tlsconn, nil
 }
 
-func createTlsClientConn(conn net.Conn, mf *messageFactory, tlsconf *tls.Config) (*tls.Conn, error) {
-	return createTlsConn(conn, mf, tlsconf, tls.Client, nil)
+func createTlsClientConn(conn net.Conn, mf *messageFactory, tlsconf *tls.Config, provider securityProvider) (*tls.Conn, error) {
+	return createTlsConn(conn, mf, tlsconf, provider, tls.Client, nil)
 }
 
-func createTlsServerConn(conn net.Conn, mf *messageFactory, tlsconf *tls.Config, initbuf []byte) (*tls.Conn, error) {
-	return createTlsConn(conn, mf, tlsconf, tls.Server, initbuf)
+func createTlsServerConn(conn net.Conn, mf *messageFactory, tlsconf *tls.Config, provider securityProvider, initbuf []byte) (*tls.Conn, error) {
+	return createTlsConn(conn, mf, tlsconf, provider, tls.Server, initbuf)
 }
 
 func (c *fabricSecureConn) handshakeComplete() bool {
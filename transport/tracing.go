@@ -0,0 +1,47 @@
+package transport
+
+import (
+	"context"
+	"encoding/binary"
+)
+
+type activityContextKey struct{}
+
+// ContextWithActivity attaches a FabricActivityId to ctx,
+// RequestReply puts it into the FabricActivity header so calls can be correlated across hops
+func ContextWithActivity(ctx context.Context, activityId FabricActivityId) context.Context {
+	return context.WithValue(ctx, activityContextKey{}, activityId)
+}
+
+func ActivityFromContext(ctx context.Context) (FabricActivityId, bool) {
+	a, ok := ctx.Value(activityContextKey{}).(FabricActivityId)
+	if !ok || a.IsEmpty() {
+		return FabricActivityId{}, false
+	}
+
+	return a, true
+}
+
+// ApplyActivity sets the FabricActivity header from ctx if there is one
+func ApplyActivity(ctx context.Context, h *MessageHeaders) {
+	if a, ok := ActivityFromContext(ctx); ok {
+		h.SetFabricActivity(a)
+	}
+}
+
+// TraceId is the activity guid in the same byte order as its string form, compatible with OpenTelemetry trace.TraceID
+func (a FabricActivityId) TraceId() [16]byte {
+	var b [16]byte
+	binary.BigEndian.PutUint32(b[0:4], a.Id.Data1)
+	binary.BigEndian.PutUint16(b[4:6], a.Id.Data2)
+	binary.BigEndian.PutUint16(b[6:8], a.Id.Data3)
+	copy(b[8:], a.Id.Data4[:])
+	return b
+}
+
+// SpanId is the activity index, compatible with OpenTelemetry trace.SpanID
+func (a FabricActivityId) SpanId() [8]byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], a.Index)
+	return b
+}